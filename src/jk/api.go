@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The control API lets test harnesses drive a running daemon over HTTP.
+// Requests and responses are JSON; errors are {"error": "..."} with a 4xx or
+// 5xx status.
+//
+//	GET    /api/containers       the containers, their addresses and states
+//	GET    /api/faults           the active faults
+//	POST   /api/faults           inject a fault: a JSON fault spec, or the
+//	                             text form taken by daemon -fault. the
+//	                             reply describes the new fault
+//	DELETE /api/faults/ID        heal one fault
+//	DELETE /api/faults           heal every fault
+//	GET    /api/scenario         the scenario being played, if any
+//	POST   /api/scenario         play a scenario's timeline
+//	DELETE /api/scenario         stop it and heal the faults it injected
+//	GET    /api/probing          whether probing is paused
+//	POST   /api/probing/pause    stop probing
+//	POST   /api/probing/resume   start probing again
+//	GET    /api/matrix           the latest result of every probe of every link
+
+// api serves the control API for a cluster.
+type api struct {
+	containers map[string]*container
+	faults     *faultManager
+
+	mu       sync.Mutex
+	scenario *apiScenario
+}
+
+// apiScenario is a scenario being played by the daemon.
+type apiScenario struct {
+	sc      *scenario
+	started time.Time
+	stop    chan bool
+	done    chan bool
+
+	// stopping is set by the DELETE that closed stop, under api.mu.
+	stopping bool
+}
+
+func newAPI(containers map[string]*container, faults *faultManager) *api {
+	return &api{containers: containers, faults: faults}
+}
+
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/containers", a.handleContainers)
+	mux.HandleFunc("/api/faults", a.handleFaults)
+	mux.HandleFunc("/api/faults/", a.handleFault)
+	mux.HandleFunc("/api/scenario", a.handleScenario)
+	mux.HandleFunc("/api/probing", a.handleProbing)
+	mux.HandleFunc("/api/probing/", a.handleProbing)
+	mux.HandleFunc("/api/matrix", a.handleMatrix)
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func replyError(w http.ResponseWriter, status int, err error) {
+	reply(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// allow replies 405 unless r uses one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	return false
+}
+
+func (a *api) handleContainers(w http.ResponseWriter, r *http.Request) {
+	if allow(w, r, "GET") {
+		reply(w, http.StatusOK, membersMessage(a.containers).Members)
+	}
+}
+
+func (a *api) listFaults() []faultInfo {
+	faults := a.faults.Info()
+	if faults == nil {
+		faults = []faultInfo{}
+	}
+	return faults
+}
+
+func (a *api) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		reply(w, http.StatusOK, a.listFaults())
+	case "POST":
+		spec, err := readFaultSpec(r)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := spec.checkNodes(func(name string) bool { return inCluster(a.containers, name) }); err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		info, err := a.faults.Inject(spec)
+		if err != nil {
+			replyError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reply(w, http.StatusCreated, info)
+	case "DELETE":
+		a.faults.HealAll()
+		reply(w, http.StatusOK, a.listFaults())
+	}
+}
+
+// readFaultSpec reads a fault spec from the body of r, either as JSON or in
+// the text form.
+func readFaultSpec(r *http.Request) (*faultSpec, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '{' {
+		spec := &faultSpec{}
+		if err := json.Unmarshal(b, spec); err != nil {
+			return nil, err
+		}
+		if _, err := spec.build(); err != nil {
+			return nil, err
+		}
+		return spec, nil
+	}
+	return parseFaultSpec(string(b))
+}
+
+func (a *api) handleFault(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "DELETE") {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/faults/"))
+	if err != nil {
+		replyError(w, http.StatusNotFound, fmt.Errorf("bad fault id: %v", err))
+		return
+	}
+	if err := a.faults.Heal(id); err != nil {
+		replyError(w, http.StatusNotFound, err)
+		return
+	}
+	reply(w, http.StatusOK, a.listFaults())
+}
+
+// scenarioStatus describes the scenario being played.
+type scenarioStatus struct {
+	Running  bool       `json:"running"`
+	Scenario *scenario  `json:"scenario,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+}
+
+func (a *api) handleScenario(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		var st scenarioStatus
+		if a.scenario != nil {
+			st = scenarioStatus{Running: true, Scenario: a.scenario.sc, Started: &a.scenario.started}
+		}
+		reply(w, http.StatusOK, st)
+	case "POST":
+		if a.scenario != nil {
+			replyError(w, http.StatusConflict, fmt.Errorf("scenario %q is already running", a.scenario.sc.Name))
+			return
+		}
+		sc, err := a.readScenario(r)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.scenario = &apiScenario{sc: sc, started: time.Now(), stop: make(chan bool), done: make(chan bool)}
+		go a.playScenario(a.scenario)
+		reply(w, http.StatusCreated, scenarioStatus{Running: true, Scenario: sc, Started: &a.scenario.started})
+	case "DELETE":
+		if a.scenario == nil {
+			replyError(w, http.StatusNotFound, fmt.Errorf("no scenario is running"))
+			return
+		}
+		s := a.scenario
+		if s.stopping {
+			replyError(w, http.StatusConflict, fmt.Errorf("scenario %q is already stopping", s.sc.Name))
+			return
+		}
+		s.stopping = true
+		close(s.stop)
+		a.mu.Unlock()
+		<-s.done
+		a.mu.Lock()
+		reply(w, http.StatusOK, scenarioStatus{})
+	}
+}
+
+// readScenario reads a scenario for the daemon's cluster from the body of r.
+// Only its timeline is played; it may name the containers it expects, which
+// must all exist, but never starts any.
+func (a *api) readScenario(r *http.Request) (*scenario, error) {
+	sc := &scenario{}
+	if err := json.NewDecoder(r.Body).Decode(sc); err != nil {
+		return nil, err
+	}
+	sc.Runtime = runtimeName
+	if len(sc.Containers) == 0 && sc.Count == 0 {
+		for _, c := range clusterList(a.containers) {
+			sc.Containers = append(sc.Containers, c.name)
+		}
+	}
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+	sc.Probes = nil // the daemon's own probes and workload keep running
+	sc.Workload = nil
+	for _, name := range sc.Containers {
+		if !inCluster(a.containers, name) {
+			return nil, fmt.Errorf("no container named %s", name)
+		}
+	}
+	return sc, nil
+}
+
+// playScenario runs the timeline of s and heals the faults it injected once
+// it ends or is stopped.
+func (a *api) playScenario(s *apiScenario) {
+	log.Printf("[scenario]: playing %q\n", s.sc.Name)
+	for _, id := range runTimeline(s.sc, a.faults, s.started, s.stop) {
+		a.faults.Heal(id) // most have been healed already
+	}
+	log.Printf("[scenario]: %q finished\n", s.sc.Name)
+	a.mu.Lock()
+	a.scenario = nil
+	a.mu.Unlock()
+	close(s.done)
+}
+
+func (a *api) handleProbing(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/probing":
+		if !allow(w, r, "GET") {
+			return
+		}
+	case "/api/probing/pause", "/api/probing/resume":
+		if !allow(w, r, "POST") {
+			return
+		}
+		setProbingPaused(r.URL.Path == "/api/probing/pause")
+	default:
+		replyError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+	reply(w, http.StatusOK, struct {
+		Paused bool `json:"paused"`
+	}{probingPaused()})
+}
+
+// matrix holds the latest result of every probe of every link for
+// /api/matrix. It is updated by the goroutine in startLog that sees them all.
+var matrix = struct {
+	sync.Mutex
+	latest map[latencyKey]*message
+}{
+	latest: make(map[latencyKey]*message),
+}
+
+func updateMatrix(m *message) {
+	if m.Type != msgProbe {
+		return
+	}
+	matrix.Lock()
+	matrix.latest[latencyKey{m.Src, m.Dest, m.Probe}] = m
+	matrix.Unlock()
+}
+
+func (a *api) handleMatrix(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	matrix.Lock()
+	var keys []latencyKey
+	for k := range matrix.latest {
+		keys = append(keys, k)
+	}
+	sort.Sort(byLatencyKey(keys))
+	cells := []*message{}
+	for _, k := range keys {
+		cells = append(cells, matrix.latest[k])
+	}
+	matrix.Unlock()
+	reply(w, http.StatusOK, struct {
+		Members []member   `json:"members"`
+		Cells   []*message `json:"cells"`
+	}{membersMessage(a.containers).Members, cells})
+}
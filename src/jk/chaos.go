@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	chaosSeed     int64
+	chaosRuntime  string
+	chaosCount    int
+	chaosDuration time.Duration
+	chaosEvery    time.Duration
+	chaosMaxFault time.Duration
+	chaosMenu     string
+	chaosNemesis  string
+	chaosPrint    bool
+)
+
+func init() {
+	cmdChaos.Run = runChaos
+	cmdChaos.Flag.Int64Var(&chaosSeed, "seed", 0, "")
+	cmdChaos.Flag.StringVar(&chaosRuntime, "runtime", "lxc", "")
+	cmdChaos.Flag.IntVar(&chaosCount, "count", numContainers, "")
+	cmdChaos.Flag.DurationVar(&chaosDuration, "duration", 10*time.Minute, "")
+	cmdChaos.Flag.DurationVar(&chaosEvery, "every", 30*time.Second, "")
+	cmdChaos.Flag.DurationVar(&chaosMaxFault, "max-fault", time.Minute, "")
+	cmdChaos.Flag.StringVar(&chaosMenu, "menu", "partition,kill,pause,delay,skew", "")
+	cmdChaos.Flag.StringVar(&chaosNemesis, "nemesis", "", "")
+	cmdChaos.Flag.BoolVar(&chaosPrint, "print", false, "")
+	addHistoryFlag(&cmdChaos.Flag)
+	addWorkloadFlag(&cmdChaos.Flag)
+	addKeepFlag(&cmdChaos.Flag)
+}
+
+var cmdChaos = &Command{
+	UsageLine: "chaos [flags]",
+	Short:     "inject random faults",
+	Long: `
+chaos starts the containers like daemon does and then injects faults picked at
+random from a menu for as long as the run lasts. the whole schedule is derived
+from a seed, which is logged at the start of every run together with the
+schedule itself, so a run that found a bug can be replayed exactly by passing
+the same seed and flags again, or by saving the schedule with -print and
+playing it with run.
+
+chaos supports the following flags:
+
+	-seed n
+		seed for the random schedule. defaults to the current time.
+
+	-runtime name
+		container runtime to use: lxc (default) or fake.
+
+	-count n
+		number of containers to start, named n0, n1, ... defaults to 5.
+
+	-duration d
+		how long the run lasts. defaults to 10m.
+
+	-every d
+		mean time between faults. defaults to 30s.
+
+	-max-fault d
+		longest time a fault stays injected. defaults to 1m.
+
+	-menu list
+		comma separated faults to pick from, each with an optional weight,
+		e.g. partition:3,kill. the faults are partition, majority, a
+		partition cutting off a minority, kill, pause, delay, skew and
+		drop, a one-way cut. defaults to partition, kill, pause, delay and
+		skew with weight 1.
+
+	-nemesis name
+		instead of picking faults from the menu, run one of these
+		nemeses, with -every and -max-fault as their interval and how
+		long each fault lasts:
+
+		majority   every interval, cut off a random minority
+		mixed      every interval, a random majority partition, kill
+		           or pause
+		storm      every interval, delay, drop and skew at once
+		rolling    kill every container in turn, one after the other
+		flapping   every interval, three short partitions in a row,
+		           each followed by a short delay
+
+		see 'jk help run' for what nemeses are made of.
+
+	-print
+		print the schedule as a scenario file instead of running it.
+`+historyFlagDoc+workloadFlagDoc+keepFlagDoc,
+}
+
+// chaosFaults lists the faults chaos can pick from by menu name. Each
+// returns a random fault against nodes, or nil if it cannot be applied.
+var chaosFaults = map[string]func(r *rand.Rand, nodes []string) *faultSpec{
+	"partition": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) < 2 {
+			return nil
+		}
+		shuffled := shuffle(r, nodes)
+		cut := 1 + r.Intn(len(nodes)-1)
+		return &faultSpec{Type: "partition", Groups: [][]string{shuffled[:cut], shuffled[cut:]}}
+	},
+	"majority": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) < 2 {
+			return nil
+		}
+		// cut off a minority, which cannot make progress on its own
+		most := max(1, (len(nodes)-1)/2)
+		cut := 1 + r.Intn(most)
+		shuffled := shuffle(r, nodes)
+		return &faultSpec{Type: "partition", Groups: [][]string{shuffled[:cut], shuffled[cut:]}}
+	},
+	"kill": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) == 0 {
+			return nil
+		}
+		return &faultSpec{Type: "kill", Node: nodes[r.Intn(len(nodes))]}
+	},
+	"pause": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) == 0 {
+			return nil
+		}
+		return &faultSpec{Type: "pause", Node: nodes[r.Intn(len(nodes))]}
+	},
+	"delay": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) < 2 {
+			return nil
+		}
+		pair := shuffle(r, nodes)[:2]
+		delay := time.Duration(50+r.Intn(450)) * time.Millisecond
+		return &faultSpec{Type: "netem", Src: pair[0], Dest: pair[1], Delay: duration(delay), Jitter: duration(delay / 10)}
+	},
+	"drop": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) < 2 {
+			return nil
+		}
+		pair := shuffle(r, nodes)[:2]
+		return &faultSpec{Type: "drop", Src: pair[0], Dest: pair[1]}
+	},
+	"skew": func(r *rand.Rand, nodes []string) *faultSpec {
+		if len(nodes) == 0 {
+			return nil
+		}
+		offset := time.Duration(1+r.Intn(300)) * time.Second
+		if r.Intn(2) == 0 {
+			offset = -offset
+		}
+		return &faultSpec{Type: "skew", Node: nodes[r.Intn(len(nodes))], Offset: duration(offset)}
+	},
+}
+
+// chaosNemeses lists the nemeses chaos can run by name. Each returns a
+// nemesis against nodes that starts a round every interval, with faults
+// lasting up to maxFault.
+var chaosNemeses = map[string]func(nodes []string, interval, maxFault time.Duration) *nemesis{
+	"majority": func(nodes []string, interval, maxFault time.Duration) *nemesis {
+		return every(interval, forDuration(maxFault, pickNemesis("majority")))
+	},
+	"mixed": func(nodes []string, interval, maxFault time.Duration) *nemesis {
+		return every(interval, randomOneOf(
+			forDuration(maxFault, pickNemesis("majority")),
+			forDuration(maxFault, pickNemesis("kill")),
+			forDuration(maxFault, pickNemesis("pause"))))
+	},
+	"storm": func(nodes []string, interval, maxFault time.Duration) *nemesis {
+		return every(interval, parallel(
+			forDuration(maxFault, pickNemesis("delay")),
+			forDuration(maxFault, pickNemesis("drop")),
+			forDuration(maxFault, pickNemesis("skew"))))
+	},
+	"rolling": func(nodes []string, interval, maxFault time.Duration) *nemesis {
+		var kills []*nemesis
+		for _, node := range nodes {
+			kills = append(kills, forDuration(maxFault, faultNemesis(&faultSpec{Type: "kill", Node: node})))
+		}
+		return every(interval, sequence(kills...))
+	},
+	"flapping": func(nodes []string, interval, maxFault time.Duration) *nemesis {
+		short := maxFault / 6
+		if short < time.Second {
+			short = time.Second
+		}
+		return every(interval, repeat(3, sequence(
+			forDuration(short, pickNemesis("partition")),
+			forDuration(short, pickNemesis("delay")))))
+	},
+}
+
+// menuItem is a fault on the chaos menu and how often to pick it.
+type menuItem struct {
+	name   string
+	weight int
+}
+
+func parseMenu(s string) ([]menuItem, error) {
+	var menu []menuItem
+	for _, item := range strings.Split(s, ",") {
+		name, weight := item, 1
+		if i := strings.Index(item, ":"); i >= 0 {
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("bad weight in %q", item)
+			}
+			name, weight = item[:i], w
+		}
+		if _, ok := chaosFaults[name]; !ok {
+			return nil, fmt.Errorf("unknown fault %q", name)
+		}
+		menu = append(menu, menuItem{name, weight})
+	}
+	// the same menu must pick the same faults however it was written
+	sort.Sort(byMenuName(menu))
+	return menu, nil
+}
+
+type byMenuName []menuItem
+
+func (m byMenuName) Len() int           { return len(m) }
+func (m byMenuName) Less(i, j int) bool { return m[i].name < m[j].name }
+func (m byMenuName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// chaosSchedule derives a timeline of random faults against nodes from r.
+// Faults arrive as a Poisson process with mean interval every and each heals
+// itself after up to maxFault. A container is not picked for kill, pause or
+// skew again while an earlier one of those still holds it.
+func chaosSchedule(r *rand.Rand, nodes []string, menu []menuItem, length, every, maxFault time.Duration) []*scenarioStep {
+	total := 0
+	for _, item := range menu {
+		total += item.weight
+	}
+	var steps []*scenarioStep
+	busy := make(map[string]time.Duration)
+	at := time.Duration(0)
+	for total > 0 {
+		at += time.Duration(r.ExpFloat64() * float64(every)).Truncate(time.Millisecond)
+		if at >= length {
+			break
+		}
+		pick := r.Intn(total)
+		var item menuItem
+		for _, item = range menu {
+			if pick < item.weight {
+				break
+			}
+			pick -= item.weight
+		}
+
+		candidates := freeNodes(item.name, nodes, busy, at)
+		if len(candidates) == 0 {
+			continue
+		}
+		spec := chaosFaults[item.name](r, candidates)
+		if spec == nil {
+			continue
+		}
+		spec.Duration = duration(time.Duration(1+r.Int63n(int64(maxFault/time.Second))) * time.Second)
+		if spec.Node != "" {
+			busy[spec.Node] = at + time.Duration(spec.Duration)
+		}
+		steps = append(steps, &scenarioStep{At: duration(at), Inject: spec})
+	}
+	return append(steps, &scenarioStep{At: duration(length), End: true})
+}
+
+// freeNodes returns the nodes the chaos fault name may pick at the offset
+// at. Kill, pause and skew take a container for themselves, so for those it
+// leaves out the nodes busy says an earlier fault still holds, or heals only
+// then: that heal may run after the new fault is injected.
+func freeNodes(name string, nodes []string, busy map[string]time.Duration, at time.Duration) []string {
+	if name != "kill" && name != "pause" && name != "skew" {
+		return nodes
+	}
+	var free []string
+	for _, n := range nodes {
+		if busy[n] < at {
+			free = append(free, n)
+		}
+	}
+	return free
+}
+
+// shuffle returns a shuffled copy of names.
+func shuffle(r *rand.Rand, names []string) []string {
+	shuffled := make([]string, len(names))
+	for i, j := range r.Perm(len(names)) {
+		shuffled[i] = names[j]
+	}
+	return shuffled
+}
+
+func runChaos(c *Command, args []string) {
+	if len(args) != 0 {
+		c.Usage()
+	}
+	menu, err := parseMenu(chaosMenu)
+	if err != nil {
+		log.Fatalf("[error]: -menu: %v\n", err)
+	}
+	if chaosEvery <= 0 || chaosMaxFault < time.Second {
+		log.Fatalf("[error]: -every must be positive and -max-fault at least 1s\n")
+	}
+	if chaosSeed == 0 {
+		chaosSeed = time.Now().UnixNano()
+	}
+	if _, ok := chaosNemeses[chaosNemesis]; !ok && chaosNemesis != "" {
+		log.Fatalf("[error]: -nemesis: unknown nemesis %q\n", chaosNemesis)
+	}
+
+	work, err := loadWorkload()
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	sc := &scenario{
+		Name:     fmt.Sprintf("chaos seed %d", chaosSeed),
+		Runtime:  chaosRuntime,
+		Count:    chaosCount,
+		Workload: work,
+	}
+	if err := sc.validate(); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	r := rand.New(rand.NewSource(chaosSeed))
+	if chaosNemesis != "" {
+		n := chaosNemeses[chaosNemesis](sc.Containers, chaosEvery, chaosMaxFault)
+		if err := n.validate(); err != nil {
+			log.Fatalf("[error]: -nemesis: %v\n", err)
+		}
+		steps, _ := n.timeline(r, sc.Containers, 0, chaosDuration)
+		sc.Timeline = append(steps, &scenarioStep{At: duration(chaosDuration), End: true})
+	} else {
+		sc.Timeline = chaosSchedule(r, sc.Containers, menu, chaosDuration, chaosEvery, chaosMaxFault)
+	}
+	if err := sc.validate(); err != nil {
+		log.Fatalf("[error]: generated an invalid schedule: %v\n", err)
+	}
+
+	if chaosPrint {
+		b, err := json.MarshalIndent(sc, "", "\t")
+		if err != nil {
+			log.Fatalf("[error]: %v\n", err)
+		}
+		os.Stdout.Write(append(b, '\n'))
+		return
+	}
+
+	log.Printf("[chaos]: seed %d\n", chaosSeed)
+	for _, step := range sc.Timeline {
+		if step.Inject != nil {
+			log.Printf("[chaos]: +%v %v\n", time.Duration(step.At), step.Inject)
+		}
+	}
+	playScenario(sc, sc.Name)
+	log.Printf("[chaos]: replay with -seed %d\n", chaosSeed)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var chaosNodes = []string{"n0", "n1", "n2", "n3", "n4"}
+
+func chaosJSON(t *testing.T, steps []*scenarioStep) string {
+	b, err := json.Marshal(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestChaosScheduleSeed(t *testing.T) {
+	menu, err := parseMenu("partition:3,kill,pause,delay,skew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := func(seed int64, menu []menuItem) string {
+		r := rand.New(rand.NewSource(seed))
+		return chaosJSON(t, chaosSchedule(r, chaosNodes, menu, 10*time.Minute, 30*time.Second, time.Minute))
+	}
+	a := schedule(42, menu)
+	if b := schedule(42, menu); a != b {
+		t.Errorf("the same seed gave different schedules:\n%s\n%s", a, b)
+	}
+	if b := schedule(43, menu); a == b {
+		t.Errorf("different seeds gave the same schedule")
+	}
+
+	// the order of the menu does not matter
+	shuffled, err := parseMenu("skew,delay,pause,kill,partition:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := schedule(42, shuffled); a != b {
+		t.Errorf("the same menu written in another order gave a different schedule")
+	}
+}
+
+func TestChaosSchedule(t *testing.T) {
+	menu, err := parseMenu("partition,kill,pause,delay,skew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, maxFault := 10*time.Minute, time.Minute
+	for seed := int64(1); seed <= 20; seed++ {
+		steps := chaosSchedule(rand.New(rand.NewSource(seed)), chaosNodes, menu, length, 10*time.Second, maxFault)
+		if last := steps[len(steps)-1]; !last.End || time.Duration(last.At) != length {
+			t.Fatalf("seed %d: schedule does not end at %v", seed, length)
+		}
+		busy := make(map[string]time.Duration)
+		for _, s := range steps[:len(steps)-1] {
+			at, d := time.Duration(s.At), time.Duration(s.Inject.Duration)
+			if d < time.Second || d > maxFault {
+				t.Errorf("seed %d: +%v %v lasts %v", seed, at, s.Inject, d)
+			}
+			if _, err := s.Inject.build(); err != nil {
+				t.Errorf("seed %d: +%v: %v", seed, at, err)
+			}
+			if node := s.Inject.Node; node != "" {
+				if busy[node] > at {
+					t.Errorf("seed %d: +%v %v while an earlier fault still holds %s", seed, at, s.Inject, node)
+				}
+				busy[node] = at + d
+			}
+		}
+	}
+}
+
+func TestChaosNemeses(t *testing.T) {
+	length := 5 * time.Minute
+	for name, build := range chaosNemeses {
+		for _, faultLength := range []time.Duration{20 * time.Second, 2 * time.Minute} {
+			testChaosNemesis(t, name, build(chaosNodes, 30*time.Second, faultLength), length)
+		}
+	}
+}
+
+// testChaosNemesis checks the timeline of the chaos nemesis name for a run
+// of length.
+func testChaosNemesis(t *testing.T, name string, n *nemesis, length time.Duration) {
+	if err := n.validate(); err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	timeline := func() []*scenarioStep {
+		steps, _ := n.timeline(rand.New(rand.NewSource(7)), chaosNodes, 0, length)
+		return steps
+	}
+	steps := timeline()
+	if len(steps) == 0 {
+		t.Errorf("%s: injects nothing", name)
+	}
+	busy := make(map[string]time.Duration)
+	for _, s := range steps {
+		at := time.Duration(s.At)
+		if at+time.Duration(s.Inject.Duration) > length || s.Inject.Duration <= 0 {
+			t.Errorf("%s: +%v %v does not heal within the run", name, at, s.Inject)
+		}
+		if _, err := s.Inject.build(); err != nil {
+			t.Errorf("%s: +%v: %v", name, at, err)
+		}
+		if n := s.Inject.Node; n != "" {
+			if held, ok := busy[n]; ok && held >= at {
+				t.Errorf("%s: +%v %v while %s is held until +%v", name, at, s.Inject, n, busy[n])
+			}
+			busy[n] = at + time.Duration(s.Inject.Duration)
+		}
+	}
+	if chaosJSON(t, steps) != chaosJSON(t, timeline()) {
+		t.Errorf("%s: the same seed gave different schedules", name)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	cmdCheck.Run = runCheck
+}
+
+var cmdCheck = &Command{
+	UsageLine: "check file",
+	Short:     "check a recorded workload for linearizability",
+	Long: `
+check reads a history file written with -history by a daemon, run or chaos
+that ran a client workload, and checks every run in it for linearizability:
+whether some order of the register operations that agrees with real time,
+each taking effect at one instant between its invocation and completion,
+explains every value read.
+
+operations that failed are left out. operations whose outcome is unknown
+may have taken effect at any point after they were invoked, or not at all.
+
+if a run is not linearizable, check prints the shortest stretch of it from
+the start that is not, without the reads that are not needed to show it,
+and marks the operation whose completion cannot be explained. the exit
+status is 1 if any run is not linearizable.
+
+a workload is a JSON object with the fields:
+
+	type         register
+	client       cmd (default), or memory, a register inside the daemon
+	             that is always linearizable, to try things out
+	read         shell command printing the register's value, or nothing
+	             if it is empty
+	write        shell command setting it to {value}
+	cas          shell command setting it to {new} if it is {old}, and
+	             exiting with status 1 if it is not
+	concurrency  number of clients, spread over the containers. defaults
+	             to one per container
+	interval     mean pause between a client's operations, default 100ms
+	timeout      how long an operation may take, default 5s
+	values       how many distinct values are written, default 5
+
+the commands run inside the container of the client, with {node} and {ip}
+replaced by its name and address, e.g.
+	"read": "etcdctl --endpoints {ip}:2379 get r --print-value-only"
+a command exiting with status 1 did not take effect; any other failure or a
+timeout leaves its outcome unknown.
+`,
+}
+
+func runCheck(c *Command, args []string) {
+	if len(args) != 1 {
+		c.Usage()
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	defer f.Close()
+
+	var runs [][]*message
+	var starts []time.Time
+	err = readHistory(f, func(m *message) error {
+		if m.Type == msgHello || len(starts) == 0 {
+			runs = append(runs, nil)
+			starts = append(starts, m.Time)
+		}
+		if m.Type == msgOp {
+			runs[len(runs)-1] = append(runs[len(runs)-1], m)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("[error]: %s: %v\n", args[0], err)
+	}
+
+	checked := 0
+	for i, msgs := range runs {
+		if len(msgs) == 0 {
+			continue
+		}
+		checked++
+		ops := historyOps(msgs)
+		start := starts[i]
+		fmt.Printf("run %d, started %s: %d operations, ", i+1, start.Format(time.RFC3339), len(ops))
+		sub, last := anomaly(ops)
+		if sub == nil {
+			fmt.Printf("linearizable\n")
+			continue
+		}
+		setExitStatus(1)
+		fmt.Printf("NOT linearizable\n")
+		fmt.Printf("no order of these %d operations explains %s, completed at +%v:\n\n",
+			len(sub), last.op, last.ret.Sub(start).Truncate(time.Millisecond))
+		printOps(sub, last, start)
+		fmt.Println()
+	}
+	if checked == 0 {
+		log.Fatalf("[error]: %s has no workload operations\n", args[0])
+	}
+}
+
+// printOps prints ops with their invocation and completion times relative
+// to start, marking last.
+func printOps(ops []*historyOp, last *historyOp, start time.Time) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\tINVOKED\tCOMPLETED\tPROCESS\tNODE\tOPERATION\tRESULT\n")
+	for _, op := range ops {
+		mark, ret, result := "", "?", "unknown"
+		if op == last {
+			mark = "=>"
+		}
+		if !op.pending {
+			ret, result = "+"+op.ret.Sub(start).Truncate(time.Millisecond).String(), "ok"
+		}
+		desc := op.op.F
+		switch {
+		case op.op.F == "cas":
+			desc += fmt.Sprintf(" %s->%s", formatValue(op.op.Old), formatValue(op.op.Value))
+		case op.op.F == "write" || !op.pending:
+			desc += " " + formatValue(op.op.Value)
+		}
+		fmt.Fprintf(w, "%s\t+%v\t%s\tp%d\t%s\t%s\t%s\n", mark, op.call.Sub(start).Truncate(time.Millisecond),
+			ret, op.op.Process, op.op.Node, desc, result)
+	}
+	w.Flush()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+var (
+	cleanupRuntime string
+	cleanupCount   int
+	cleanupPrefix  string
+)
+
+func init() {
+	cmdCleanup.Run = runCleanup
+	cmdCleanup.Flag.StringVar(&cleanupRuntime, "runtime", "lxc", "")
+	cmdCleanup.Flag.IntVar(&cleanupCount, "count", numContainers, "")
+	cmdCleanup.Flag.StringVar(&cleanupPrefix, "prefix", "n", "")
+}
+
+var cmdCleanup = &Command{
+	UsageLine: "cleanup [flags] [name ...]",
+	Short:     "remove what faults left behind after a crash",
+	Long: `
+cleanup removes whatever faults installed in the named containers, by
+default n0 to n4, when the daemon, run or chaos that injected them could
+not heal them, e.g. because it crashed or was killed. it must not be used
+while one of them is running. in every running container it
+
+	sends SIGCONT to the processes procstop stopped
+	deletes the iptables rules with the comment joker
+	deletes the root prio qdisc of eth0 that netem faults hang off
+	removes /etc/faketimerc and libfaketime from /etc/ld.so.preload
+	copies back and takes down the joker-* devices of eio and slowfsync,
+	with their /var/tmp/joker-*.img images
+	removes the .joker-fill files of diskfull
+
+and it thaws frozen containers. stopped containers are skipped. everything
+removed is logged.
+
+cleanup supports the following flags:
+
+	-runtime name
+		container runtime to use: lxc (default) or fake.
+
+	-count n
+		number of containers to clean up. defaults to 5.
+
+	-prefix p
+		clean up p0, p1, ... instead of n0, n1, ...
+`,
+}
+
+func runCleanup(c *Command, args []string) {
+	rt, err := newRuntime(cleanupRuntime)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	names := args
+	if len(names) == 0 {
+		names = containerNames(cleanupPrefix, cleanupCount)
+	}
+	for _, name := range names {
+		state, err := rt.State(name)
+		if err != nil {
+			log.Printf("[info]: no container named %s\n", name)
+			continue
+		}
+		if state == stateFrozen {
+			if err := rt.Unfreeze(name); err != nil {
+				log.Printf("[error]: could not thaw %s: %v\n", name, err)
+				setExitStatus(1)
+				continue
+			}
+			log.Printf("[info]: %s: thawed\n", name)
+		} else if state != stateRunning {
+			log.Printf("[info]: %s is %s, skipping\n", name, strings.ToLower(state))
+			continue
+		}
+		if err := cleanupContainer(&container{name: name, rt: rt}); err != nil {
+			log.Printf("[error]: %s: %v\n", name, err)
+			setExitStatus(1)
+		}
+	}
+}
+
+// cleanupContainer removes what faults left in c, logging every item.
+func cleanupContainer(c *container) error {
+	if err := cleanupScript(c, fmt.Sprintf(cleanupState, shellQuote(ruleComment), shellQuote(netemDev), shellQuote(faketimeLib))); err != nil {
+		return err
+	}
+
+	if err := cleanupScript(c, cleanupProcStop); err != nil {
+		return err
+	}
+
+	if err := cleanupScript(c, cleanupReadOnly); err != nil {
+		return err
+	}
+
+	out, err := c.rt.Exec(c.name, "sh", "-c", cleanupDevices)
+	if err != nil {
+		return fmt.Errorf("could not list devices: %v", err)
+	}
+	containers := map[string]*container{c.name: c}
+	prefix := "joker-" + c.name
+	for _, name := range strings.Fields(string(out)) {
+		if name != prefix && !strings.HasPrefix(name, prefix+"-") {
+			continue
+		}
+		// heal the device like the fault would if it is still mounted
+		// where its name says
+		path, err := c.rt.Exec(c.name, "awk", "-v", "d=/dev/mapper/"+name, "$1 == d { print $2; exit }", "/proc/mounts")
+		if err != nil {
+			return fmt.Errorf("could not find the mount point of %s: %v", name, err)
+		}
+		d := &diskDevice{node: c.name, path: strings.TrimSpace(string(path)), mounted: true}
+		if d.path != "" && d.name() == name {
+			err = d.Heal(containers)
+		} else {
+			err = execScript(c, diskVars(name, d.path)+diskTeardown)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("[info]: %s: removed device %s\n", c.name, name)
+	}
+
+	return cleanupScript(c, cleanupFill)
+}
+
+// cleanupScript runs script in c and logs every line it prints.
+func cleanupScript(c *container, script string) error {
+	out, err := c.rt.Exec(c.name, "sh", "-c", script)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			log.Printf("[info]: %s: %s\n", c.name, line)
+		}
+	}
+	return err
+}
+
+// cleanupState undoes the network and clock faults. It takes the rule
+// comment, the netem device and the libfaketime library.
+const cleanupState = `comment=%s dev=%s lib=%s
+iptables -S | grep -F -- "--comment $comment " | sed 's/^-A //' | while read -r rule; do
+	eval "iptables -D $rule" && echo "removed iptables rule $rule"
+done
+if tc qdisc show dev "$dev" | grep -q '^qdisc prio 1: root'; then
+	tc qdisc del dev "$dev" root && echo "removed the prio qdisc of $dev"
+fi
+if [ -e /etc/faketimerc ]; then
+	rm -f /etc/faketimerc && echo "removed /etc/faketimerc"
+fi
+if grep -qxF "$lib" /etc/ld.so.preload 2>/dev/null; then
+	sed -i "\\|^$lib\$|d" /etc/ld.so.preload && echo "removed $lib from /etc/ld.so.preload"
+fi
+true
+`
+
+// cleanupProcStop resumes the processes of procstop faults that are still
+// stopped, going by the files they leave in /run.
+const cleanupProcStop = `for f in /run/joker-*.procstop; do
+	[ -e "$f" ] || continue
+	for pid in $(cat "$f"); do
+		if ps -o stat= -p "$pid" | grep -q '^T'; then
+			kill -CONT "$pid" && echo "sent SIGCONT to stopped pid $pid"
+		fi
+	done
+	rm -f "$f"
+done
+`
+
+// cleanupReadOnly unmounts the bind mounts of readonly faults that are still
+// read-only, going by the files they leave in /run.
+const cleanupReadOnly = `for f in /run/joker-*.readonly; do
+	[ -e "$f" ] || continue
+	path=$(cat "$f")
+	if awk -v p="$path" '$2 == p { o = $4 } END { exit o !~ /^ro(,|$)/ }' /proc/mounts; then
+		umount "$path" && echo "unmounted read-only $path"
+	fi
+	rm -f "$f"
+done
+`
+
+// cleanupDevices lists the devices of eio and slowfsync faults, whether they
+// got as far as device-mapper or not.
+const cleanupDevices = `{
+	dmsetup ls 2>/dev/null | cut -f1
+	for f in /var/tmp/joker-*.img; do [ -e "$f" ] && basename "$f" .img; done
+	for d in /run/joker-*.orig; do [ -e "$d" ] && basename "$d" .orig; done
+} | sort -u
+`
+
+// cleanupFill removes the files of diskfull faults.
+const cleanupFill = `find / \( -path /proc -o -path /sys -o -path /dev \) -prune -o -name .joker-fill -type f -print |
+while read -r f; do
+	rm -f "$f" && echo "removed $f"
+done
+`
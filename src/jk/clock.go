@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faketimeLib is the libfaketime preload library inside the containers.
+var faketimeLib = "/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1"
+
+func init() {
+	faultTypes["skew"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("skew needs a node")
+			}
+			if spec.Offset == 0 && spec.Drift == 0 && spec.Jump == 0 {
+				return nil, fmt.Errorf("skew needs an offset, drift or jump")
+			}
+			if spec.Drift <= -100 {
+				return nil, fmt.Errorf("skew: drift must be above -100%%")
+			}
+			if spec.Jump != 0 && spec.Every <= 0 {
+				return nil, fmt.Errorf("skew: jump needs every")
+			}
+			return &skew{
+				node:   spec.Node,
+				offset: time.Duration(spec.Offset),
+				drift:  spec.Drift,
+				jump:   time.Duration(spec.Jump),
+				every:  time.Duration(spec.Every),
+			}, nil
+		},
+	}
+}
+
+// skew moves the wall clock seen by processes in a container. It preloads
+// libfaketime into every program started in the container through
+// /etc/ld.so.preload and configures it with /etc/faketimerc, so processes
+// that are already running keep the real time until they are restarted.
+//
+// The clock is set ahead by offset and runs drift percent faster. If jump is
+// set the daemon rewrites /etc/faketimerc every interval to leap the clock
+// by another jump; libfaketime rereads it every few seconds.
+//
+// A container has a single /etc/faketimerc, so a container already skewed
+// cannot be skewed again until that skew is healed.
+type skew struct {
+	node   string
+	offset time.Duration
+	drift  float64
+	jump   time.Duration
+	every  time.Duration
+
+	stop chan bool
+	done chan bool // closed when jumps returns
+}
+
+func (s *skew) Inject(containers map[string]*container) error {
+	c, ok := containers[s.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", s.node)
+	}
+	if current := c.Skew(); current != "" {
+		return fmt.Errorf("%s is already skewed by %s", c.name, current)
+	}
+	s.stop = make(chan bool)
+	if err := s.write(c, s.offset); err != nil {
+		return err
+	}
+	script := fmt.Sprintf("grep -qxF %s /etc/ld.so.preload || echo %s >> /etc/ld.so.preload", faketimeLib, faketimeLib)
+	if _, err := c.rt.Exec(c.name, "sh", "-c", script); err != nil {
+		return fmt.Errorf("could not skew clock on %s: %v", c.name, err)
+	}
+	c.setSkew(s.describe())
+	if s.jump != 0 {
+		s.done = make(chan bool)
+		go s.jumps(c)
+	}
+	return nil
+}
+
+// write configures libfaketime on c for the given offset.
+func (s *skew) write(c *container, offset time.Duration) error {
+	rc := signedSeconds(offset)
+	if s.drift != 0 {
+		rc += " x" + strconv.FormatFloat(1+s.drift/100, 'f', -1, 64)
+	}
+	if _, err := c.rt.Exec(c.name, "sh", "-c", fmt.Sprintf("echo '%s' > /etc/faketimerc", rc)); err != nil {
+		return fmt.Errorf("could not skew clock on %s: %v", c.name, err)
+	}
+	return nil
+}
+
+// jumps moves the clock of c by another jump every interval until the fault
+// is healed. Jumps due while c is not running, e.g. frozen, are skipped.
+func (s *skew) jumps(c *container) {
+	defer close(s.done)
+	t := time.NewTicker(s.every)
+	defer t.Stop()
+	offset := s.offset
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		if c.State() != stateRunning {
+			continue
+		}
+		offset += s.jump
+		if err := s.write(c, offset); err != nil {
+			log.Printf("[error]: %v\n", err)
+			continue
+		}
+		log.Printf("[fault]: clock of %s jumped to %s\n", c.name, signedDuration(offset))
+	}
+}
+
+func (s *skew) Heal(containers map[string]*container) error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	if s.done != nil {
+		// a jump in progress would write the file back
+		<-s.done
+	}
+	c, ok := containers[s.node]
+	if !ok {
+		return nil
+	}
+	script := fmt.Sprintf("rm -f /etc/faketimerc && sed -i '\\|^%s$|d' /etc/ld.so.preload", faketimeLib)
+	if _, err := c.rt.Exec(c.name, "sh", "-c", script); err != nil {
+		return fmt.Errorf("could not restore clock on %s: %v", c.name, err)
+	}
+	c.setSkew("")
+	return nil
+}
+
+// describe returns the configured skew as shown next to the node in watch,
+// e.g. "+1m30s x1.001 jump -5s/1m".
+func (s *skew) describe() string {
+	var words []string
+	if s.offset != 0 {
+		words = append(words, signedDuration(s.offset))
+	}
+	if s.drift != 0 {
+		words = append(words, "x"+strconv.FormatFloat(1+s.drift/100, 'f', -1, 64))
+	}
+	if s.jump != 0 {
+		words = append(words, fmt.Sprintf("jump %s/%v", signedDuration(s.jump), s.every))
+	}
+	return strings.Join(words, " ")
+}
+
+func (s *skew) String() string {
+	return s.node + " " + s.describe()
+}
+
+// signedDuration formats d with an explicit sign, e.g. +1m23s.
+func signedDuration(d time.Duration) string {
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
+
+// signedSeconds formats d as the signed seconds taken by libfaketime.
+func signedSeconds(d time.Duration) string {
+	secs := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	if d >= 0 {
+		secs = "+" + secs
+	}
+	return secs
+}
@@ -1,83 +1,185 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// stateTimeout bounds how long to wait for a container to change state.
+var stateTimeout = 20 * time.Second
+
+// Lifecycle states of a container as tracked by the daemon. The steady ones
+// match the states reported by lxc-info.
+const (
+	stateRunning  = "RUNNING"
+	stateStopped  = "STOPPED"
+	stateFrozen   = "FROZEN"
+	stateStarting = "STARTING"
+	stateStopping = "STOPPING"
+)
+
 type container struct {
 	name string
-	ip string
+	rt Runtime
 	cmd chan command
+
+	// cloned is set for containers created by a join fault, which are
+	// destroyed again when they leave.
+	cloned bool
+
+	// executorDone is closed when the probe executor of c returns. It is
+	// set under the executors lock.
+	executorDone chan bool
+
+	// netemBands are the bands of the root prio qdisc taken by netem faults.
+	// It is guarded by the faultManager's exec lock.
+	netemBands map[int]bool
+
+	mu    sync.Mutex
+	state string
+	ip    string // found again whenever c boots
+	skew  string // the clock skew injected, if any
+	boots int    // how often c booted again after a kill or restart
+}
+
+// State returns the lifecycle state the daemon last put c in.
+func (c *container) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *container) setState(state string) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+// Boots returns how often c booted again after a kill or restart. Each boot
+// loses the iptables rules, mounts and processes faults left in c.
+func (c *container) Boots() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.boots
+}
+
+// IP returns the address c had when it last booted.
+func (c *container) IP() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ip
+}
+
+// clusterMu guards the map of containers shared by the goroutines of a run.
+// join and leave faults change it while also holding the faultManager's
+// exec lock, so faults may read it under that lock alone.
+var clusterMu sync.RWMutex
+
+// isMember reports whether c is still in the cluster.
+func isMember(containers map[string]*container, c *container) bool {
+	clusterMu.RLock()
+	defer clusterMu.RUnlock()
+	return containers[c.name] == c
 }
 
-func (c *container) Start() bool {
+// clusterList returns the containers in the cluster, ordered by name.
+func clusterList(containers map[string]*container) []*container {
+	clusterMu.RLock()
+	defer clusterMu.RUnlock()
+	var list []*container
+	for _, c := range containers {
+		list = append(list, c)
+	}
+	sort.Sort(byContainerName(list))
+	return list
+}
+
+// inCluster reports whether the cluster has a container called name.
+func inCluster(containers map[string]*container, name string) bool {
+	clusterMu.RLock()
+	defer clusterMu.RUnlock()
+	_, ok := containers[name]
+	return ok
+}
+
+type byContainerName []*container
+
+func (c byContainerName) Len() int           { return len(c) }
+func (c byContainerName) Less(i, j int) bool { return lessName(c[i].name, c[j].name) }
+func (c byContainerName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Skew describes the clock skew injected into c, or is empty.
+func (c *container) Skew() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skew
+}
+
+func (c *container) setSkew(skew string) {
+	c.mu.Lock()
+	c.skew = skew
+	c.mu.Unlock()
+}
+
+// Start boots c unless it is running already and waits for it to be
+// running.
+func (c *container) Start() error {
 	c.cmd = make(chan command, 25)
-	cmd := exec.Command("sudo", "lxc-info", "-n", c.name, "-s")
-	info, err := cmd.Output()
+	state, err := c.rt.State(c.name)
 	if err != nil {
-		log.Fatalf("[error]: %s does not exist. create container and retry.\n", c.name)
-		return false
+		return fmt.Errorf("%s does not exist. create it with 'jk provision' and retry", c.name)
 	}
-	if strings.Contains(string(info), "RUNNING") {
+	if strings.Contains(state, "RUNNING") {
 		log.Printf("[info]: container named %s already running.\n", c.name)
 	} else {
-		cmd = exec.Command("sudo", "lxc-start", "-n", c.name)
-		err = cmd.Run()
+		c.setState(stateStarting)
+		err = c.rt.Start(c.name)
 		if err != nil {
-			log.Fatalf("[error]: could not start %s\n", c.name)
-			return false
+			c.setState(stateStopped)
+			return fmt.Errorf("could not start %s: %v", c.name, err)
 		}
-		cmd = exec.Command("sudo", "lxc-wait", "-n", c.name, "-s", "RUNNING", "-t", "20") // TODO: Make this timeout a package variable of flag.
-		err = cmd.Run()
+		err = c.rt.Wait(c.name, "RUNNING", stateTimeout)
 		if err != nil {
-			log.Fatalf("[error]: timeout (20 sec) before %s reached RUNNING state.\nRetry with a longer timeout.", c.name)
+			return fmt.Errorf("timeout (%v) before %s reached RUNNING state. retry with a longer timeout", stateTimeout, c.name)
 		}
 	}
 
+	c.setState(stateRunning)
 	c.findIp()
-	return true
+	return nil
 }
 
 func (c *container) findIp() {
 	retriesRemaining := 30 // TODO: should this be a counter or a total timeout?
 retry:
-	cmd := exec.Command("sudo", "lxc-info", "-n", c.name, "-i")
-	infoOut, err := cmd.Output()
-	infoOutSplit := strings.Split(string(infoOut), ":")
-	if (err != nil || len(infoOutSplit) != 2) && retriesRemaining >= 0 {
+	ip, err := c.rt.IP(c.name)
+	if err != nil && retriesRemaining >= 0 {
 		retriesRemaining--
 		time.Sleep(800 * time.Millisecond)
 		goto retry
 	}
-	if len(infoOutSplit) != 2 {
-		log.Println("[error] could not find IP address for %s\n", c.name)
+	if err != nil {
+		log.Printf("[error] could not find IP address for %s\n", c.name)
 		return
 	}
-	c.ip = strings.TrimSpace(infoOutSplit[1])
+	c.mu.Lock()
+	c.ip = ip
+	c.mu.Unlock()
 }
 
 func (c *container) Stop() {
-	cmd := exec.Command("sudo", "lxc-stop", "-n", c.name)
-	err := cmd.Run()
+	c.setState(stateStopping)
+	defer c.setState(stateStopped)
+	err := c.rt.Stop(c.name)
 	if err != nil {
 		log.Printf("[error]: failed to stop %s\n", c.name)
 	}
-	cmd = exec.Command("sudo", "lxc-wait", "-n", c.name, "-s", "STOPPED", "-t", "20") // TODO: Make this timeout a package variable of flag.
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("[error]: timeout (20 sec) before %s reached STOPPED state.\nRetry with a longer timeout.", c.name)
-	}
-}
-
-func (c *container) executeCurl(ip string) string {
-	cmd := exec.Command("sudo", "lxc-attach", "--clear-env", "-n", c.name, "--", "curl", ip, "-s", "-o", "/dev/null", "-w", "%{http_code}", "-m", "1")
-	httpStatus, err := cmd.Output()
+	err = c.rt.Wait(c.name, "STOPPED", stateTimeout)
 	if err != nil {
-		log.Printf("[error]: could not attach to %s\n", c.name)
+		log.Printf("[error]: timeout (%v) before %s reached STOPPED state.\nRetry with a longer timeout.", stateTimeout, c.name)
 	}
-	return string(httpStatus)
 }
-
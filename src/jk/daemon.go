@@ -1,20 +1,45 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const numContainers = 5
 
+// defaultProbeInterval is the pause between rounds of the connectivity matrix.
+const defaultProbeInterval = 4 * time.Second
+
+var runtimeName string
+var initialFaults faultFlag
+var daemonProbes probeFlag
+var httpAddr string
+var httpPublic bool
+
+// defaultHTTPAddr is where the daemon serves metrics and the control API.
+var defaultHTTPAddr = "localhost:" + strconv.Itoa(defaultPort+1)
+
 func init() {
 	cmdDaemon.Run = runDaemon
+	cmdDaemon.Flag.StringVar(&runtimeName, "runtime", "lxc", "")
+	cmdDaemon.Flag.Var(&initialFaults, "fault", "")
+	cmdDaemon.Flag.Var(&daemonProbes, "probe", "")
+	cmdDaemon.Flag.StringVar(&httpAddr, "http", defaultHTTPAddr, "")
+	cmdDaemon.Flag.BoolVar(&httpPublic, "http-public", false, "")
+	cmdDaemon.Flag.StringVar(&cloneBase, "base", cloneBase, "")
+	addHistoryFlag(&cmdDaemon.Flag)
+	addWorkloadFlag(&cmdDaemon.Flag)
+	addKeepFlag(&cmdDaemon.Flag)
 }
 
 var cmdDaemon = &Command {
@@ -25,33 +50,154 @@ daemon runs a server that manages container lifetimes, executes commands, and se
 
 daemon supports the following flags:
 
+	-runtime name
+		container runtime to use: lxc (default) or fake. the fake runtime
+		runs entirely in process and needs neither lxc nor root.
+
+	-fault spec
+		inject a fault once the containers are up. may be repeated.
+		e.g. -fault 'partition {n0,n1}|{n2,n3,n4}'
+		     -fault 'netem n0 n1 delay=100ms jitter=10ms loss=1% for=30s'
+		netem takes delay, jitter, loss, duplicate, reorder and corrupt.
+		it only shapes packets from src to dest, so a netem fault is a
+		one-way delay. drop n0 n1 is a one-way cut: n0 can no longer
+		open connections to n1, while n1 still reaches n0.
+		kill, pause and restart take a container: -fault 'pause n2'.
+		the firewall rules, mounts and stopped processes of other faults
+		in a container that is killed or restarted are gone once it
+		boots again; those faults stay listed until they are healed.
+		skew n2 moves the wall clock seen by programs started in n2
+		with libfaketime: offset=-30s sets it back, drift=0.5% makes it
+		run faster, jump=5s every=1m leaps it forward once a minute. a
+		skewed container cannot be skewed again until that is healed.
+		diskfull n2 /data fills the file system holding /data with a
+		file of size=bytes or as large as the free space. if that is
+		the host's file system, as for a path on the root of a container
+		kept in a directory, the host fills up as well, so give a path
+		on a mount of its own or a size. eio n2 /data
+		makes reads and writes under /data fail with EIO, slowfsync n2
+		/data delay=500ms holds back every write and fsync, both by moving
+		/data onto a device-mapper device of size=1G, so the container
+		must be allowed loop and dm devices. readonly n2 /data remounts
+		it read-only.
+		procstop n2 postgres sends SIGSTOP to the processes named postgres
+		in n2, or to the pid in a pidfile given by its absolute path, and
+		SIGCONT when healed. prockill sends SIGKILL and, if words follow
+		the process, runs them as a shell command when healed to start it
+		again: prockill n2 postgres service postgresql start for=10s.
+		join n5 clones a new container n5 from the base container, boots
+		it and adds it to the cluster; healing it destroys n5 again.
+		leave n2 takes n2 out of the cluster and stops it, destroying it
+		only if it joined. it cannot be healed.
+		any fault with for=duration heals itself after that long.
+
+	-base name
+		the stopped container join faults clone unless their spec has a
+		base=name. defaults to joker-base.
+
+	-probe spec
+		how to check connectivity between every pair of containers. may be
+		repeated to run several probes side by side. defaults to http.
+		e.g. -probe 'tcp port=5432 interval=2s'
+		     -probe 'http port=8080 path=/health method=HEAD status=204'
+		     -probe 'cmd timeout=3s redis-cli -h {ip} ping'
+		the types are http (port, path, method, status), tcp (port), udp
+		echo (port, default 7), icmp, dns (port, query) and cmd, which runs
+		the rest of the spec as a shell command with {src}, {dest} and {ip}
+		replaced. every probe takes name, interval (default 4s) and timeout
+		(default 1s).
+
+	-http addr
+		serve HTTP on addr, localhost:31416 by default, or nowhere if it
+		is empty. /metrics has probe counts, success ratios and latency
+		histograms by src, dest and probe, active faults by type, the
+		state of every container and the number of connected watches in
+		the Prometheus text format.
+		/api/ is a JSON control API to list containers, inject and heal
+		faults, play and stop scenario timelines, pause and resume
+		probing, and read the latest connectivity matrix:
+
+		GET    /api/containers       containers, addresses and states
+		GET    /api/faults           active faults
+		POST   /api/faults           inject a JSON or text fault spec
+		DELETE /api/faults/ID        heal one fault
+		DELETE /api/faults           heal every fault
+		GET    /api/scenario         the scenario being played, if any
+		POST   /api/scenario         play a scenario's timeline against
+		                             the running containers
+		DELETE /api/scenario         stop it and heal its faults
+		GET    /api/probing          whether probing is paused
+		POST   /api/probing/pause    stop probing
+		POST   /api/probing/resume   start probing again
+		GET    /api/matrix           latest result of every probe
+
+		the API has no authentication: whoever can reach it can run
+		commands as root in the containers, e.g. with a prockill
+		restart command. so addr must be on a loopback interface
+		unless -http-public is given.
+
+	-http-public
+		allow -http to listen on addresses other hosts can reach.
+`+historyFlagDoc+workloadFlagDoc+keepFlagDoc+`
+sending the daemon SIGUSR1 heals every active fault. on SIGINT, SIGTERM or
+SIGHUP the daemon stops probing and the workload, waits for the probes in
+flight, heals every active fault and stops the containers before it exits;
+a second signal makes it exit at once. if it could not, 'jk cleanup' removes
+what the faults left behind.
 `,
 }
 
 func runDaemon(c *Command, args []string) {
+	if httpAddr != "" && !httpPublic && !loopbackAddr(httpAddr) {
+		log.Fatalf("[error]: -http: %s is not a loopback address; the API is unauthenticated, give -http-public to serve it there anyway\n", httpAddr)
+	}
 	l := startDisplaySocket()
 	defer l.Close()
 
-	containers := launchContainers(numContainers)
-	startCurlExecutors(containers, startLog(l))
-	go curlConnectivityMatrixGenerator(containers)
+	rt, err := newRuntime(runtimeName)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+
+	names := containerNames("n", numContainers)
+	hist := openHistory()
+	defer hist.Close()
+
+	if len(daemonProbes) == 0 {
+		daemonProbes = probeFlag{{Type: "http"}}
+	}
+	if err := validateProbes(daemonProbes); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	work, err := loadWorkload()
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
 
-	signalChan := make(chan os.Signal, 100)
-	signal.Notify(signalChan, syscall.SIGINT)
+	ctx := stopContext()
+	s := startSession(ctx, l, rt, names, daemonProbes, work, hist)
+	containers, faults := s.containers, s.faults
+
+	if httpAddr != "" {
+		startHTTP(httpAddr, containers, faults)
+	}
+	for _, spec := range initialFaults {
+		if _, err := faults.Inject(spec); err != nil {
+			log.Printf("[error]: could not inject %s: %v\n", spec.Type, err)
+		}
+	}
+
+	healChan := make(chan os.Signal, 100)
+	signal.Notify(healChan, syscall.SIGUSR1)
 
 	for {
 		select {
-		case sig := <-signalChan:
-			switch sig {
-			case syscall.SIGINT:
-				for _, c := range containers {
-					c.Stop()
-				}
-				os.Exit(0)
-			default:
-			}
+		case <-healChan:
+			faults.HealAll()
+		case <-ctx.Done():
+			s.shutdown()
+			return
 		}
-
 	}
 }
 
@@ -64,39 +210,132 @@ func startDisplaySocket() net.Listener {
 	return l
 }
 
-func curlConnectivityMatrixGenerator(containers map[string]*container) {
+// loopbackAddr reports whether the listen address addr is only reachable
+// from this host. An address without a host listens on every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startHTTP serves the daemon's HTTP endpoints on addr.
+func startHTTP(addr string, containers map[string]*container, faults *faultManager) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(containers, faults))
+	newAPI(containers, faults).register(mux)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[error]: could not listen for HTTP: %v\n", err)
+	}
+	go http.Serve(l, mux)
+}
+
+// startProbes runs a connectivity matrix generator for each probe until ctx
+// is done, and returns a WaitGroup counting them. The specs must have been
+// validated.
+func startProbes(ctx context.Context, containers map[string]*container, specs []*probeSpec) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, spec := range specs {
+		p, _ := spec.build()
+		wg.Add(1)
+		go func(cmd command, interval time.Duration) {
+			defer wg.Done()
+			connectivityMatrixGenerator(ctx, containers, cmd, interval)
+		}(command{name: spec.Name, probe: p}, time.Duration(spec.Interval))
+	}
+	return &wg
+}
+
+// probing is whether the connectivity matrix generators are paused.
+var probing = struct {
+	sync.Mutex
+	paused bool
+}{}
+
+func probingPaused() bool {
+	probing.Lock()
+	defer probing.Unlock()
+	return probing.paused
+}
+
+func setProbingPaused(paused bool) {
+	probing.Lock()
+	probing.paused = paused
+	probing.Unlock()
+	log.Printf("[info]: probing paused: %t\n", paused)
+}
+
+// connectivityMatrixGenerator asks every container to run cmd.probe against
+// every container, once per interval, unless probing is paused. It returns
+// once ctx is done.
+func connectivityMatrixGenerator(ctx context.Context, containers map[string]*container, cmd command, interval time.Duration) {
 	for {
-		for _, dest := range containers {
-			for _, src := range containers {
-				src.cmd <- []byte(dest.ip)
+		list := clusterList(containers)
+		for _, dest := range list {
+			if probingPaused() {
+				break
+			}
+			for _, src := range list {
+				// skip the containers that left since the round began
+				if !isMember(containers, src) || !isMember(containers, dest) {
+					continue
+				}
+				cmd.dest = dest
+				select {
+				case src.cmd <- cmd:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 
-		time.Sleep(4 * time.Second)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func launchContainers(n int) map[string]*container {
+func launchContainers(rt Runtime, names []string) map[string]*container {
 	containers := make(map[string] *container)
-	for i := 0; i < n; i++ {
-		c := &container{name: fmt.Sprintf("n%d", i)}
-		started := c.Start()
-		if !started {
-			log.Printf("[error]: failed to start %s\n", c.name)
-			continue
+	for _, name := range names {
+		c := &container{name: name, rt: rt}
+		if err := c.Start(); err != nil {
+			log.Fatalf("[error]: %v\n", err)
 		}
 		containers[c.name] = c
 	}
 	return containers
 }
 
-func startLog(l net.Listener) chan *status {
-	logChan := make(chan *status, 200)
-	clientChan := make(chan net.Conn, 10)
+// startLog accepts watch clients on l and sends every message received on
+// logChan to all of them. Each client gets a snapshot of the membership and
+// the active faults right after the handshake, and may then send commands to
+// change the faults. Every message, starting with a snapshot, is also
+// recorded in hist. The latency percentiles of every link are added every
+// latencyReportInterval. Sending nil on logChan disconnects the clients and
+// closes the returned channel once every message before it has been sent.
+func startLog(l net.Listener, logChan chan *message, containers map[string]*container, faults *faultManager, hist *historyLog) <-chan bool {
+	snapshot := func() []*message {
+		m := newMessage(msgFaults)
+		m.Faults = faults.Info()
+		return []*message{membersMessage(containers), m}
+	}
+	for _, m := range snapshot() {
+		hist.Record(m)
+	}
+	clientChan := make(chan *client, 10)
 	go func() {
 		var delay time.Duration
 		for {
-			client, err := l.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				if ne, ok := err.(net.Error); ok && ne.Temporary() {
 					if delay == 0 {
@@ -113,76 +352,256 @@ func startLog(l net.Listener) chan *status {
 				return
 			}
 			delay = 0
-			clientChan <- client
+			go func() {
+				c := &client{conn: conn, enc: json.NewEncoder(conn)}
+				dec := json.NewDecoder(conn)
+				if err := acceptHandshake(conn, c.enc, dec); err != nil {
+					log.Printf("[error]: rejected watch %v: %v\n", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				for _, m := range snapshot() {
+					if err := c.send(m); err != nil {
+						conn.Close()
+						return
+					}
+				}
+				clientChan <- c
+				c.serveCommands(dec, containers, faults)
+			}()
 		}
 	}()
 
+	done := make(chan bool)
 	go func() {
-		var clients []net.Conn
+		defer close(done)
+		clients := make(map[*client]bool)
+		broadcast := func(update *message) {
+			hist.Record(update)
+			countMessage(update)
+			updateMatrix(update)
+			for c := range clients {
+				if err := c.send(update); err != nil {
+					log.Printf("[info]: dropping watch %v: %v\n", c.conn.RemoteAddr(), err)
+					c.conn.Close()
+					delete(clients, c)
+					setWatchClients(len(clients))
+				}
+			}
+		}
+		latency := newLatencyStats()
+		report := time.NewTicker(latencyReportInterval)
 		for {
 			select {
 			case update := <-logChan:
 				if update == nil {
+					for c := range clients {
+						c.conn.Close()
+					}
+					report.Stop()
 					return
 				}
-				log.Printf("[status]: %s\n", update.summary)
-				for _, c := range clients { // TODO: should this be done in goroutines?
-					msg := fmt.Sprintf("%s %s %t\n", update.src, update.dest, update.outcome) // TODO: pick a better serialization protocol
-					n, err := c.Write([]byte(msg))
-					if err != nil {
-						continue
-					}
-					if n != len(msg) {
-						log.Println("whole message not sent.")
-						// TODO: clearly this should actually try to send the rest of the message...
-					}
+				if update.Type == msgProbe {
+					log.Printf("[status]: %v\n", update)
+					latency.add(update)
+				}
+				broadcast(update)
+			case <-report.C:
+				if len(latency.links) > 0 {
+					broadcast(latency.message())
 				}
-			case client := <-clientChan:
-				clients = append(clients, client) // TODO: clearly not the best data structure (think removes). perhaps a map would be better
-			default:
-				time.Sleep(30*time.Millisecond) // TODO: revisit duration of sleep. arbitrarily chosen to reduce wasted cpu cycles.
+			case c := <-clientChan:
+				clients[c] = true
+				setWatchClients(len(clients))
 			}
 		}
 	}()
-	return logChan
+	return done
 }
 
-type command []byte
+// client is a watch connected to the daemon.
+type client struct {
+	conn net.Conn
 
-func containerNameByIp(containers map[string]*container, ip string) string {
-	for _, c := range containers {
-		if c.ip == ip {
-			return c.name
+	mu  sync.Mutex // serializes writes
+	enc *json.Encoder
+}
+
+// clientWriteTimeout keeps a stalled watch from holding up the others.
+const clientWriteTimeout = time.Second
+
+func (c *client) send(m *message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.enc.Encode(m)
+}
+
+// serveCommands executes the commands sent by c until it hangs up, and
+// answers each with a result.
+func (c *client) serveCommands(dec *json.Decoder, containers map[string]*container, faults *faultManager) {
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			return // the broadcaster notices the hangup
+		}
+		if m.Type != msgCommand || m.Command == nil {
+			continue
+		}
+		log.Printf("[info]: watch %v: %v\n", c.conn.RemoteAddr(), m.Command)
+		reply := newMessage(msgResult)
+		if err := runCommand(m.Command, containers, faults); err != nil {
+			reply.Error = err.Error()
 		}
+		c.send(reply)
 	}
-	return ""
 }
 
+// runCommand executes a command sent by watch.
+func runCommand(cmd *watchCommand, containers map[string]*container, faults *faultManager) error {
+	switch cmd.Action {
+	case "inject":
+		if cmd.Spec == nil {
+			return fmt.Errorf("inject without a fault")
+		}
+		err := cmd.Spec.checkNodes(func(name string) bool { return inCluster(containers, name) })
+		if err != nil {
+			return err
+		}
+		_, err = faults.Inject(cmd.Spec)
+		return err
+	case "heal":
+		return faults.Heal(cmd.ID)
+	case "heal-all":
+		faults.HealAll()
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", cmd.Action)
+}
 
-func startCurlExecutors(containers map[string]*container, output chan *status) {
-	for _, c := range containers {
-		go func(c *container, out chan *status) {
-			for {
-				select {
-				case ip := <-c.cmd:
-					if ip == nil {
-						return
-					}
+// membersMessage describes the containers for a newly connected watch.
+func membersMessage(containers map[string]*container) *message {
+	m := newMessage(msgMembers)
+	for _, c := range clusterList(containers) {
+		m.Members = append(m.Members, member{Name: c.name, IP: c.IP(), State: c.State(), Skew: c.Skew()})
+	}
+	return m
+}
 
-					success := false
-					if "200" == c.executeCurl(string(ip)) {
-						success = true
-					}
+// lessName orders container names so that numbers in them compare by value,
+// putting n2 before n10.
+func lessName(a, b string) bool {
+	for a != "" && b != "" {
+		i, j := digitsPrefix(a), digitsPrefix(b)
+		if i > 0 && j > 0 {
+			x, _ := strconv.Atoi(a[:i])
+			y, _ := strconv.Atoi(b[:j])
+			if x != y {
+				return x < y
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
 
-					out <-&status{
-						src: c.name,
-						dest: containerNameByIp(containers, string(ip)),
-						summary: fmt.Sprintf("curl %s from %s %t", ip, c.name, success),
-						outcome: success,
-					}
+// digitsPrefix returns the number of leading decimal digits in s.
+func digitsPrefix(s string) int {
+	i := 0
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// command asks a container to run the named probe against dest.
+type command struct {
+	name  string
+	probe probe
+	dest  *container
+}
+
+func startProbeExecutors(containers map[string]*container, output chan *message) {
+	executors.Lock()
+	defer executors.Unlock()
+	executors.output = output
+	for _, c := range clusterList(containers) {
+		startProbeExecutor(c, output)
+	}
+}
+
+// stopProbeExecutors stops the probe executors of containers once the
+// probes they were asked to run are done, and waits for them. The matrix
+// generators must have stopped.
+func stopProbeExecutors(containers map[string]*container) {
+	executors.Lock()
+	executors.output = nil
+	executors.Unlock()
+	for _, c := range clusterList(containers) {
+		c.cmd <- command{}
+	}
+	executors.wg.Wait()
+}
+
+// stopProbeExecutor stops the probe executor of c, if it has one, and waits
+// for it. c must have been taken out of the cluster.
+func stopProbeExecutor(c *container) {
+	executors.Lock()
+	done := c.executorDone
+	executors.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case c.cmd <- command{}:
+	case <-done: // stopped with the others already
+	}
+	<-done
+}
+
+// executors is where the probe executors send their results, kept for the
+// executors of containers that join the cluster later.
+var executors = struct {
+	sync.Mutex
+	output chan *message
+	wg     sync.WaitGroup // counts the running executors
+}{}
+
+// startProbeExecutor runs the probes c is asked to run until it is sent a
+// command without a probe. The caller must hold the executors lock.
+func startProbeExecutor(c *container, out chan *message) {
+	done := make(chan bool)
+	c.executorDone = done
+	executors.wg.Add(1)
+	go func() {
+		defer executors.wg.Done()
+		defer close(done)
+		for {
+			select {
+			case cmd := <-c.cmd:
+				if cmd.probe == nil {
+					return
 				}
 
+				m := newMessage(msgProbe)
+				m.Src = c.name
+				m.Dest = cmd.dest.name
+				m.Probe = cmd.name
+				// attaching to a frozen container would block until it thaws
+				if c.State() == stateRunning {
+					r := cmd.probe.Check(c, cmd.dest)
+					m.OK = r.ok
+					m.Code = r.code
+					m.Latency = duration(r.latency)
+				}
+				out <- m
 			}
-		}(c, output)
-	}
+
+		}
+	}()
 }
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// The dashboard is the connectivity matrix drawn by watch: one row per
+// source container and one column per destination, laid out for however
+// many containers the daemon reports. The arrow keys move a cursor over the
+// cells; when the matrix does not fit in the terminal only part of it is
+// drawn and it scrolls to keep the cursor in view.
+//
+//	from\to  n0   n1   n2
+//	       +----+----+----+
+//	n0     | ██ | ██ | ██ |
+//	       +----+----+----+
+//	...
+var board = struct {
+	sync.Mutex
+	members []member
+	index   map[string]int
+	cells   map[link]status
+	latency map[latencyKey]linkLatency
+	faults  []faultInfo
+	event   string
+	footer  string
+
+	// first row and column drawn
+	row, col int
+
+	// the cell under the cursor
+	curRow, curCol int
+
+	// help is shown over the matrix until the next key press
+	help []string
+
+	// heatmap shades the cells by latency instead of pass/fail
+	heatmap bool
+}{
+	index:   make(map[string]int),
+	cells:   make(map[link]status),
+	latency: make(map[latencyKey]linkLatency),
+}
+
+// link is a directed pair of containers.
+type link struct {
+	src, dest string
+}
+
+// gridLayout is where the visible part of the matrix goes on the screen.
+type gridLayout struct {
+	x0, y0     int // top left corner of the grid
+	cellWidth  int
+	rows, cols int // how many rows and columns fit
+}
+
+// layout computes the grid layout for the current members and terminal
+// size and clamps the scroll position to it. The caller must hold board.
+func layout() gridLayout {
+	w, h := termbox.Size()
+	name := 4
+	for _, m := range board.members {
+		if len(m.Name) > name {
+			name = len(m.Name)
+		}
+	}
+	l := gridLayout{x0: name + 2, y0: 1, cellWidth: name}
+	if l.x0 < len("from\\to ") {
+		l.x0 = len("from\\to ")
+	}
+	n := len(board.members)
+	l.cols = min((w-l.x0-1)/(l.cellWidth+1), n)
+	l.rows = min((h-l.y0-5)/2, n) // leave room for the event, faults and footer lines
+	board.curRow = max(0, min(board.curRow, n-1))
+	board.curCol = max(0, min(board.curCol, n-1))
+	board.row = max(0, min(board.row, n-l.rows))
+	board.col = max(0, min(board.col, n-l.cols))
+	return l
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// setMembers replaces the containers shown by the dashboard and redraws it.
+func setMembers(members []member) {
+	board.Lock()
+	updateMembers(members)
+	board.Unlock()
+	drawGrid()
+}
+
+// updateMembers replaces the containers shown. The caller must hold board.
+func updateMembers(members []member) {
+	board.members = members
+	board.index = make(map[string]int)
+	for i, m := range members {
+		board.index[m.Name] = i
+	}
+}
+
+// resetBoard forgets everything the dashboard shows, without drawing.
+func resetBoard() {
+	board.Lock()
+	defer board.Unlock()
+	updateMembers(nil)
+	board.cells = make(map[link]status)
+	board.latency = make(map[latencyKey]linkLatency)
+	board.faults = nil
+	board.event = ""
+}
+
+// applyMessage updates what the dashboard shows for m without drawing, so
+// that many messages can be applied before a single drawGrid.
+func applyMessage(m *message) {
+	board.Lock()
+	defer board.Unlock()
+	switch m.Type {
+	case msgMembers:
+		updateMembers(m.Members)
+	case msgProbe:
+		if shownProbe(m) {
+			board.cells[link{m.Src, m.Dest}] = probeStatus(m)
+		}
+	case msgFault:
+		board.event = eventText(m)
+	case msgLatency:
+		updateLatency(m)
+	case msgFaults:
+		board.faults = m.Faults
+	}
+}
+
+// setFaults shows the active faults in m and redraws the dashboard.
+func setFaults(m *message) {
+	board.Lock()
+	board.faults = m.Faults
+	board.Unlock()
+	drawGrid()
+}
+
+// updateLatency stores the percentiles in m. The caller must hold board.
+func updateLatency(m *message) {
+	for _, l := range m.Latencies {
+		board.latency[latencyKey{l.Src, l.Dest, l.Probe}] = l
+	}
+}
+
+// setLatency stores the percentiles in m and redraws the dashboard.
+func setLatency(m *message) {
+	board.Lock()
+	updateLatency(m)
+	board.Unlock()
+	drawGrid()
+}
+
+// toggleHeatmap switches between the pass/fail and the heatmap view.
+func toggleHeatmap() {
+	board.Lock()
+	board.heatmap = !board.heatmap
+	if board.heatmap {
+		termbox.SetOutputMode(termbox.Output256)
+	} else {
+		termbox.SetOutputMode(termbox.OutputNormal)
+	}
+	board.Unlock()
+	drawGrid()
+}
+
+// shownProbe reports whether the results of m's probe are shown, see watch
+// -probe.
+func shownProbe(m *message) bool {
+	return watchProbe == "" || m.Probe == watchProbe
+}
+
+func probeStatus(m *message) status {
+	return status{src: m.Src, dest: m.Dest, probe: m.Probe, outcome: m.OK, latency: time.Duration(m.Latency)}
+}
+
+func eventText(m *message) string {
+	return m.Time.Format("15:04:05") + " " + m.String()
+}
+
+// setFooter shows s on the last line of the dashboard.
+func setFooter(s string) {
+	board.Lock()
+	defer board.Unlock()
+	board.footer = s
+	y := eventLine(layout()) + 2
+	clearLine(y)
+	drawString(s, 0, y, fgColor)
+	termbox.Flush()
+}
+
+func clearLine(y int) {
+	w, _ := termbox.Size()
+	for x := 0; x < w; x++ {
+		termbox.SetCell(x, y, ' ', fgColor, bgColor)
+	}
+}
+
+// moveCursor moves the cursor by rows and cols, scrolling the matrix to keep
+// it in view.
+func moveCursor(rows, cols int) {
+	board.Lock()
+	board.curRow += rows
+	board.curCol += cols
+	l := layout()
+	board.row = max(min(board.row, board.curRow), board.curRow-l.rows+1)
+	board.col = max(min(board.col, board.curCol), board.curCol-l.cols+1)
+	board.Unlock()
+	drawGrid()
+}
+
+// cursor returns the source and destination under the cursor, or false if
+// there are no containers.
+func cursor() (string, string, bool) {
+	board.Lock()
+	defer board.Unlock()
+	if len(board.members) == 0 {
+		return "", "", false
+	}
+	layout()
+	return board.members[board.curRow].Name, board.members[board.curCol].Name, true
+}
+
+// memberNames returns the names of the containers shown.
+func memberNames() []string {
+	board.Lock()
+	defer board.Unlock()
+	var names []string
+	for _, m := range board.members {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// showHelp shows lines over the matrix until the next key press, or hides
+// it again if lines is nil.
+func showHelp(lines []string) {
+	board.Lock()
+	board.help = lines
+	board.Unlock()
+	drawGrid()
+}
+
+// helpShown reports whether help is being shown.
+func helpShown() bool {
+	board.Lock()
+	defer board.Unlock()
+	return board.help != nil
+}
+
+func drawString(s string, x0, y0 int, fg termbox.Attribute) {
+	i := 0
+	for _, c := range s {
+		termbox.SetCell(x0+i, y0, c, fg, bgColor)
+		i++
+	}
+}
+
+// fit pads or truncates s to exactly n characters.
+func fit(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return fmt.Sprintf("%-*s", n, s)
+}
+
+func drawGrid() {
+	board.Lock()
+	defer board.Unlock()
+	termbox.Clear(fgColor, bgColor)
+	l := layout()
+	n := len(board.members)
+
+	drawString("from\\to", 0, 0, fgColor)
+	x := l.x0
+	if board.heatmap {
+		x = drawLegend(x, l.y0+2*l.rows+1) + 2
+	}
+	if l.rows < n || l.cols < n {
+		drawString(fmt.Sprintf("rows %d-%d cols %d-%d of %d",
+			board.row+1, board.row+l.rows, board.col+1, board.col+l.cols, n), x, l.y0+2*l.rows+1, fgColor)
+	}
+	border := "+"
+	for j := 0; j < l.cols; j++ {
+		dest := board.members[board.col+j]
+		fg := stateColor(dest.State)
+		if board.col+j == board.curCol {
+			fg |= termbox.AttrReverse
+		}
+		drawString(fit(dest.Name, l.cellWidth), l.x0+1+j*(l.cellWidth+1), 0, fg)
+		border += strings.Repeat("-", l.cellWidth) + "+"
+	}
+	for i := 0; i <= l.rows; i++ {
+		drawString(border, l.x0, l.y0+2*i, fgColor)
+	}
+	for i := 0; i < l.rows; i++ {
+		src := board.members[board.row+i]
+		y := l.y0 + 2*i + 1
+		fg := stateColor(src.State)
+		if board.row+i == board.curRow {
+			fg |= termbox.AttrReverse
+		}
+		drawString(fit(src.Name, l.x0-1), 0, y, fg)
+		for j := 0; j <= l.cols; j++ {
+			drawString("|", l.x0+j*(l.cellWidth+1), y, fgColor)
+		}
+		for j := 0; j < l.cols; j++ {
+			dest := board.members[board.col+j]
+			if s, ok := board.cells[link{src.Name, dest.Name}]; ok {
+				drawCell(l, s)
+			}
+		}
+		if src.Skew != "" {
+			// clipped by termbox if the grid fills the terminal
+			drawString("clock "+src.Skew, l.x0+l.cols*(l.cellWidth+1)+2, y, termbox.ColorYellow)
+		}
+	}
+	if n > 0 {
+		src, dest := board.members[board.curRow].Name, board.members[board.curCol].Name
+		if x, y, ok := curlOutputCell(l, src, dest); ok {
+			drawString("[", x-1, y, fgColor)
+			drawString("]", x+2, y, fgColor)
+		}
+	}
+	drawString(board.event, 0, eventLine(l), fgColor)
+	drawString(faultsText(), 0, eventLine(l)+1, fgColor)
+	drawString(board.footer, 0, eventLine(l)+2, fgColor)
+	if board.help != nil {
+		drawHelp(board.help)
+	}
+	termbox.HideCursor()
+	termbox.Flush()
+}
+
+// faultsText is the status bar listing the active faults. The caller must
+// hold board.
+func faultsText() string {
+	if len(board.faults) == 0 {
+		return "no active faults"
+	}
+	var words []string
+	for _, f := range board.faults {
+		words = append(words, fmt.Sprintf("#%d %s %s", f.ID, f.Spec.Type, f.Desc))
+	}
+	return "faults: " + strings.Join(words, "  ")
+}
+
+// drawHelp draws lines in a box in the middle of the screen.
+func drawHelp(lines []string) {
+	w, h := termbox.Size()
+	width := 0
+	for _, line := range lines {
+		width = max(width, len([]rune(line)))
+	}
+	x0, y0 := max(0, (w-width-4)/2), max(0, (h-len(lines)-2)/2)
+	border := "+" + strings.Repeat("-", width+2) + "+"
+	drawString(border, x0, y0, fgColor)
+	for i, line := range lines {
+		drawString("| "+fit(line, width)+" |", x0, y0+1+i, fgColor)
+	}
+	drawString(border, x0, y0+1+len(lines), fgColor)
+}
+
+// stateColor is the colour of a container's name in the given state.
+func stateColor(state string) termbox.Attribute {
+	switch state {
+	case stateRunning:
+		return fgColor
+	case stateFrozen:
+		return termbox.ColorCyan
+	case stateStopped:
+		return termbox.ColorRed
+	}
+	return termbox.ColorYellow
+}
+
+func drawStatus(s status) {
+	board.Lock()
+	defer board.Unlock()
+	board.cells[link{s.src, s.dest}] = s
+	if board.help != nil {
+		return
+	}
+	l := layout()
+	drawCell(l, s)
+	// whether the reverse link is drawn as asymmetric may have changed
+	if r, ok := board.cells[link{s.dest, s.src}]; ok && s.src != s.dest {
+		drawCell(l, r)
+	}
+	termbox.Flush()
+}
+
+// drawCell draws the cell for s if it is visible. The caller must hold board.
+func drawCell(l gridLayout, s status) {
+	x, y, ok := curlOutputCell(l, s.src, s.dest)
+	if !ok {
+		return
+	}
+	if board.heatmap {
+		if !s.outcome {
+			drawString("--", x, y, termbox.ColorRed)
+			return
+		}
+		latency := s.latency
+		if l, ok := board.latency[latencyKey{s.src, s.dest, s.probe}]; ok {
+			latency = time.Duration(l.P95)
+		}
+		drawString("██", x, y, heatColor(latency))
+		return
+	}
+	fg := termbox.ColorRed
+	if s.outcome {
+		fg = termbox.ColorGreen
+		if s.latency > slowThreshold {
+			fg = termbox.ColorYellow
+		}
+	} else if asymmetric(s) {
+		fg = termbox.ColorMagenta
+	}
+
+	drawString("██", x, y, fg)
+}
+
+// asymmetric reports whether s failed while the reverse link works. The
+// caller must hold board.
+func asymmetric(s status) bool {
+	r, ok := board.cells[link{s.dest, s.src}]
+	return ok && !s.outcome && r.outcome
+}
+
+// heatScale maps latencies to colours of the 256 colour palette, from green
+// through yellow to red.
+var heatScale = []struct {
+	below time.Duration
+	color int
+}{
+	{time.Millisecond, 46},
+	{2 * time.Millisecond, 82},
+	{5 * time.Millisecond, 118},
+	{10 * time.Millisecond, 154},
+	{20 * time.Millisecond, 190},
+	{50 * time.Millisecond, 226},
+	{100 * time.Millisecond, 220},
+	{200 * time.Millisecond, 214},
+	{500 * time.Millisecond, 208},
+	{time.Second, 202},
+}
+
+// heatColor is the heatmap colour of a latency.
+func heatColor(d time.Duration) termbox.Attribute {
+	for _, h := range heatScale {
+		if d < h.below {
+			return termbox.Attribute(h.color + 1)
+		}
+	}
+	return termbox.Attribute(196 + 1)
+}
+
+// drawLegend explains the heatmap colours at x, y and returns where it ends.
+func drawLegend(x, y int) int {
+	drawString("p95 ", x, y, fgColor)
+	x += 4
+	for _, h := range heatScale {
+		drawString("█", x, y, heatColor(h.below-1))
+		x++
+	}
+	drawString("█", x, y, heatColor(time.Hour))
+	x++
+	s := fmt.Sprintf(" %v..%v+  -- failing", heatScale[0].below, heatScale[len(heatScale)-1].below)
+	drawString(s, x, y, fgColor)
+	return x + len(s)
+}
+
+// drawEvent shows a line describing the latest event below the grid.
+func drawEvent(s string) {
+	board.Lock()
+	defer board.Unlock()
+	board.event = s
+	if board.help != nil {
+		return
+	}
+	y := eventLine(layout())
+	clearLine(y)
+	drawString(s, 0, y, fgColor)
+	termbox.Flush()
+}
+
+func eventLine(l gridLayout) int {
+	return l.y0 + 2*l.rows + 2
+}
+
+// curlOutputCell returns where the cell for src to dest is drawn, or false
+// if either is unknown or scrolled out of view.
+func curlOutputCell(l gridLayout, src, dest string) (int, int, bool) {
+	i, ok := board.index[src]
+	if !ok {
+		return 0, 0, false
+	}
+	j, ok := board.index[dest]
+	if !ok {
+		return 0, 0, false
+	}
+	i -= board.row
+	j -= board.col
+	if i < 0 || i >= l.rows || j < 0 || j >= l.cols {
+		return 0, 0, false
+	}
+	x := l.x0 + 1 + j*(l.cellWidth+1) + (l.cellWidth-2)/2
+	y := l.y0 + 1 + 2*i
+	return x, y, true
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultDiskSize is the size of the device a path is moved to by eio and
+// slowfsync faults. What is in the path must fit.
+const defaultDiskSize = "1G"
+
+func init() {
+	faultTypes["diskfull"] = &faultType{
+		args: nodePathArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			// there is no default path: / of a container is often
+			// a directory on the host's file system
+			if err := checkNodePath(spec, true); err != nil {
+				return nil, err
+			}
+			return &diskFull{node: spec.Node, path: spec.Path, size: spec.Size}, nil
+		},
+	}
+	faultTypes["eio"] = &faultType{
+		args: nodePathArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			if err := checkNodePath(spec, true); err != nil {
+				return nil, err
+			}
+			return newDiskDevice(spec, "error"), nil
+		},
+	}
+	faultTypes["slowfsync"] = &faultType{
+		args: nodePathArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			if err := checkNodePath(spec, true); err != nil {
+				return nil, err
+			}
+			if spec.Delay <= 0 {
+				return nil, fmt.Errorf("slowfsync needs a delay")
+			}
+			ms := max(1, int(time.Duration(spec.Delay)/time.Millisecond))
+			return newDiskDevice(spec, fmt.Sprintf("delay $loop 0 0 $loop 0 %d", ms)), nil
+		},
+	}
+	faultTypes["readonly"] = &faultType{
+		args: nodePathArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			if err := checkNodePath(spec, true); err != nil {
+				return nil, err
+			}
+			return &readOnly{node: spec.Node, path: spec.Path}, nil
+		},
+	}
+}
+
+// nodePathArgs is the args function of storage faults, which take a
+// container and a path inside it, e.g. eio n2 /var/lib/db.
+func nodePathArgs(spec *faultSpec, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		spec.Node = args[0]
+	case 2:
+		spec.Node, spec.Path = args[0], args[1]
+	default:
+		return fmt.Errorf("%s: want a container and a path, got %q", spec.Type, strings.Join(args, " "))
+	}
+	return nil
+}
+
+func checkNodePath(spec *faultSpec, needPath bool) error {
+	if spec.Node == "" {
+		return fmt.Errorf("%s needs a node", spec.Type)
+	}
+	if spec.Path == "" && needPath {
+		return fmt.Errorf("%s needs a path", spec.Type)
+	}
+	if spec.Path != "" && !strings.HasPrefix(spec.Path, "/") {
+		return fmt.Errorf("%s: path %s is not absolute", spec.Type, spec.Path)
+	}
+	return nil
+}
+
+// validSize reports whether s is a size as taken by fallocate and truncate:
+// a number of bytes with an optional K, M, G or T suffix.
+func validSize(s string) bool {
+	s = strings.TrimRight(s, "KMGT")
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// execScript runs a shell script inside c.
+func execScript(c *container, script string) error {
+	if _, err := c.rt.Exec(c.name, "sh", "-c", script); err != nil {
+		return fmt.Errorf("%v on %s", err, c.name)
+	}
+	return nil
+}
+
+// diskFull fills the file system holding path by allocating a file in it,
+// either size bytes large or as large as the free space. Healing removes it.
+// If that file system is shared with the host, as the root of a container
+// kept in a directory is, the host fills up too.
+type diskFull struct {
+	node, path, size string
+}
+
+func (d *diskFull) file() string {
+	return strings.TrimSuffix(d.path, "/") + "/.joker-fill"
+}
+
+func (d *diskFull) Inject(containers map[string]*container) error {
+	c, ok := containers[d.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", d.node)
+	}
+	size := d.size
+	if size == "" {
+		size = fmt.Sprintf("$(df --output=avail -B1 %s | tail -n 1)", shellQuote(d.path))
+	}
+	if err := execScript(c, fmt.Sprintf("fallocate -l %s %s", size, shellQuote(d.file()))); err != nil {
+		return fmt.Errorf("could not fill %s: %v", d.path, err)
+	}
+	return nil
+}
+
+func (d *diskFull) Heal(containers map[string]*container) error {
+	c, ok := containers[d.node]
+	if !ok {
+		return nil
+	}
+	if err := execScript(c, "rm -f "+shellQuote(d.file())); err != nil {
+		return fmt.Errorf("could not free %s: %v", d.path, err)
+	}
+	return nil
+}
+
+func (d *diskFull) String() string {
+	if d.size != "" {
+		return fmt.Sprintf("%s:%s full (%s)", d.node, d.path, d.size)
+	}
+	return fmt.Sprintf("%s:%s full", d.node, d.path)
+}
+
+// diskDevice moves the contents of a directory onto a device-mapper device
+// backed by a loop device, mounted over the directory, and then swaps the
+// device's table for one that breaks it: error fails every read and write
+// with EIO, delay holds back writes and flushes, and so every fsync. On
+// heal the table is swapped back, what was written in the meantime is copied
+// to the original directory and the device is taken down again.
+//
+// The container must be allowed to use loop devices and device-mapper,
+// which usually means it is privileged. Device-mapper names are shared with
+// the host, so devices are named joker-node-path.
+type diskDevice struct {
+	node, path, size string
+	kind             string // the fault type, for String
+	table            string // the dm table target; $loop is the loop device
+
+	mounted bool
+}
+
+func newDiskDevice(spec *faultSpec, table string) *diskDevice {
+	size := spec.Size
+	if size == "" {
+		size = defaultDiskSize
+	}
+	return &diskDevice{node: spec.Node, path: spec.Path, size: size, kind: spec.Type, table: table}
+}
+
+// name is the device-mapper name of the device.
+func (d *diskDevice) name() string {
+	return "joker-" + d.node + strings.Replace(strings.TrimSuffix(d.path, "/"), "/", "-", -1)
+}
+
+// vars sets the shell variables used by the scripts of d.
+func (d *diskDevice) vars() string {
+	return diskVars(d.name(), d.path)
+}
+
+// diskVars sets the shell variables used by the scripts of the device called
+// name for path.
+func diskVars(name, path string) string {
+	return fmt.Sprintf("name=%s path=%s img=%s orig=%s\n", shellQuote(name), shellQuote(path),
+		shellQuote("/var/tmp/"+name+".img"), shellQuote("/run/"+name+".orig"))
+}
+
+// diskTeardown takes down whatever part of a device was set up, given the
+// variables set by diskVars.
+const diskTeardown = `grep -q "^/dev/mapper/$name " /proc/mounts && umount -l "$path"
+dmsetup info "$name" >/dev/null 2>&1 && dmsetup remove --retry "$name"
+for loop in $(losetup -j "$img" | cut -d: -f1); do losetup -d "$loop"; done
+rm -f "$img"
+mountpoint -q "$orig" && umount "$orig"
+rmdir "$orig" 2>/dev/null
+! dmsetup info "$name" >/dev/null 2>&1
+`
+
+// swap replaces the table of the device, finding its loop device and size
+// from the backing image.
+func (d *diskDevice) swap(c *container, table string) error {
+	script := d.vars() + `set -e
+loop=$(losetup -j "$img" | cut -d: -f1)
+sectors=$(blockdev --getsz "$loop")
+dmsetup suspend "$name"
+dmsetup load "$name" --table "0 $sectors ` + table + `"
+dmsetup resume "$name"
+`
+	return execScript(c, script)
+}
+
+func (d *diskDevice) Inject(containers map[string]*container) error {
+	c, ok := containers[d.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", d.node)
+	}
+	// keep the original directory reachable at $orig to copy it over now
+	// and back when healing
+	script := d.vars() + `set -e
+mkdir -p "$orig"
+mount --bind "$path" "$orig"
+truncate -s ` + d.size + ` "$img"
+loop=$(losetup -f --show "$img")
+mkfs.ext4 -q "$loop"
+dmsetup create "$name" --table "0 $(blockdev --getsz "$loop") linear $loop 0"
+mount "/dev/mapper/$name" "$path"
+cp -a "$orig/." "$path/"
+sync
+`
+	if err := execScript(c, script); err != nil {
+		return fmt.Errorf("could not set up a device for %s: %v", d.path, err)
+	}
+	d.mounted = true
+	if err := d.swap(c, d.table); err != nil {
+		return fmt.Errorf("could not break %s: %v", d.path, err)
+	}
+	return nil
+}
+
+func (d *diskDevice) Heal(containers map[string]*container) error {
+	c, ok := containers[d.node]
+	if !ok {
+		return nil
+	}
+	var copyErr error
+	if d.mounted {
+		if err := d.swap(c, "linear $loop 0"); err != nil {
+			return fmt.Errorf("could not repair %s: %v", d.path, err)
+		}
+		if err := execScript(c, d.vars()+`cp -a "$path/." "$orig/"`); err != nil {
+			copyErr = fmt.Errorf("could not copy %s back: %v", d.path, err)
+		}
+	}
+	// take down whatever Inject got to set up
+	if err := execScript(c, d.vars()+diskTeardown); err != nil {
+		return fmt.Errorf("could not remove the device for %s: %v", d.path, err)
+	}
+	return copyErr
+}
+
+func (d *diskDevice) String() string {
+	return fmt.Sprintf("%s:%s %s", d.node, d.path, d.kind)
+}
+
+// readOnly bind mounts a directory over itself and remounts the bind mount
+// read-only, so writes fail with EROFS. Healing unmounts it. While it is
+// mounted, a file in /run named after it holds the path for cleanup.
+type readOnly struct {
+	node, path string
+	bound      bool
+	boots      map[string]int
+}
+
+func (r *readOnly) marker() string {
+	return "/run/joker-" + r.node + strings.Replace(strings.TrimSuffix(r.path, "/"), "/", "-", -1) + ".readonly"
+}
+
+func (r *readOnly) Inject(containers map[string]*container) error {
+	c, ok := containers[r.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", r.node)
+	}
+	r.boots = bootCounts(containers, r.node)
+	path := shellQuote(r.path)
+	if err := execScript(c, "mount --bind "+path+" "+path); err != nil {
+		return fmt.Errorf("could not bind mount %s: %v", r.path, err)
+	}
+	r.bound = true
+	if err := execScript(c, "echo "+path+" > "+shellQuote(r.marker())); err != nil {
+		return fmt.Errorf("could not write %s: %v", r.marker(), err)
+	}
+	if err := execScript(c, "mount -o remount,bind,ro "+path); err != nil {
+		return fmt.Errorf("could not remount %s read-only: %v", r.path, err)
+	}
+	return nil
+}
+
+func (r *readOnly) Heal(containers map[string]*container) error {
+	c, ok := containers[r.node]
+	if !ok || !r.bound || rebooted(r.boots, c) {
+		return nil // the mount and /run went with the reboot
+	}
+	if err := execScript(c, "umount "+shellQuote(r.path)+" && rm -f "+shellQuote(r.marker())); err != nil {
+		return fmt.Errorf("could not unmount %s: %v", r.path, err)
+	}
+	return nil
+}
+
+func (r *readOnly) String() string {
+	return fmt.Sprintf("%s:%s read-only", r.node, r.path)
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fault is a failure that can be injected into a set of running containers
+// and later healed again. Inject and Heal are each called at most once.
+type fault interface {
+	Inject(containers map[string]*container) error
+	Heal(containers map[string]*container) error
+	String() string
+}
+
+// instantFault is implemented by faults that are over as soon as they have
+// been injected, like restart. They never become active or need healing.
+type instantFault interface {
+	instant()
+}
+
+// removingFault is implemented by faults that take a container out of the
+// cluster, like leave. They cannot be injected while an active fault
+// involves that container, as it could not be healed any more.
+type removingFault interface {
+	removes() string
+}
+
+// lifecycleFault is implemented by faults that only start, stop, freeze or
+// clone containers and never run commands inside them, like pause. Other
+// faults cannot be injected into a frozen container, where a command would
+// block until it thaws, and their heals wait for it to thaw.
+type lifecycleFault interface {
+	lifecycle()
+}
+
+// bootCounts returns how often each named container has booted, for a fault
+// to remember when it is injected.
+func bootCounts(containers map[string]*container, names ...string) map[string]int {
+	boots := make(map[string]int)
+	for _, name := range names {
+		if c, ok := containers[name]; ok {
+			boots[name] = c.Boots()
+		}
+	}
+	return boots
+}
+
+// rebooted reports whether c booted again since boots was taken, so that
+// what a fault installed in it is gone and there is nothing left to heal.
+func rebooted(boots map[string]int, c *container) bool {
+	n, ok := boots[c.name]
+	return ok && c.Boots() != n
+}
+
+// faultSpec is the serializable description of a fault. Which fields are
+// meaningful depends on Type.
+type faultSpec struct {
+	Type   string     `json:"type"`
+	Groups [][]string `json:"groups,omitempty"`
+	Src    string     `json:"src,omitempty"`
+	Dest   string     `json:"dest,omitempty"`
+	Node   string     `json:"node,omitempty"`
+
+	// Base is the container a join clones, see membership.go.
+	Base string `json:"base,omitempty"`
+
+	// clock skew, see clock.go: Offset is how far a skewed clock is ahead
+	// (or behind, if negative), Drift how many percent faster (or slower)
+	// it runs, and Jump how far it leaps forward (or back) every Every.
+	Offset duration `json:"offset,omitempty"`
+	Drift  float64  `json:"drift,omitempty"`
+	Jump   duration `json:"jump,omitempty"`
+	Every  duration `json:"every,omitempty"`
+
+	// storage faults, see disk.go: the directory to break and how big a
+	// file or device to use, in the size format of fallocate, e.g. 512M.
+	Path string `json:"path,omitempty"`
+	Size string `json:"size,omitempty"`
+
+	// process faults, see proc.go: the process to signal, by name or by
+	// the absolute path of its pidfile, and the shell command that starts
+	// it again after a prockill.
+	Process string `json:"process,omitempty"`
+	Restart string `json:"restart,omitempty"`
+
+	// link degradation, see netem.go
+	Delay     duration `json:"delay,omitempty"`
+	Jitter    duration `json:"jitter,omitempty"`
+	Loss      float64  `json:"loss,omitempty"`
+	Duplicate float64  `json:"duplicate,omitempty"`
+	Reorder   float64  `json:"reorder,omitempty"`
+	Corrupt   float64  `json:"corrupt,omitempty"`
+
+	// Duration, if set, heals the fault automatically after it has been
+	// active that long.
+	Duration duration `json:"duration,omitempty"`
+}
+
+// faultType knows how to parse and build one kind of fault.
+type faultType struct {
+	// args fills in spec from the positional words of a text spec.
+	args func(spec *faultSpec, args []string) error
+
+	// build validates spec and returns the fault it describes.
+	build func(spec *faultSpec) (fault, error)
+}
+
+// faultTypes lists the available faults by the name used in specs. Each
+// fault registers itself from an init function in its own file.
+var faultTypes = map[string]*faultType{}
+
+// parseFaultSpec parses the text form of a fault: the fault type followed by
+// positional words and key=value options, e.g.
+//
+//	partition {n0,n1}|{n2,n3,n4}
+//	netem n0 n1 delay=100ms jitter=10ms loss=1% for=30s
+func parseFaultSpec(s string) (*faultSpec, error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty fault spec")
+	}
+	spec := &faultSpec{Type: words[0]}
+	ft, ok := faultTypes[spec.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown fault type %q", spec.Type)
+	}
+	var args []string
+	for _, w := range words[1:] {
+		i := strings.Index(w, "=")
+		if i < 0 {
+			args = append(args, w)
+			continue
+		}
+		if err := spec.set(w[:i], w[i+1:]); err != nil {
+			return nil, err
+		}
+	}
+	if ft.args != nil {
+		if err := ft.args(spec, args); err != nil {
+			return nil, err
+		}
+	} else if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected arguments %q", spec.Type, strings.Join(args, " "))
+	}
+	return spec, nil
+}
+
+// set assigns a key=value option from a text spec.
+func (s *faultSpec) set(key, value string) error {
+	switch key {
+	case "groups":
+		groups, err := parseGroups(value)
+		if err != nil {
+			return err
+		}
+		s.Groups = groups
+	case "node":
+		s.Node = value
+	case "src":
+		s.Src = value
+	case "dest":
+		s.Dest = value
+	case "base":
+		s.Base = value
+	case "path":
+		s.Path = value
+	case "process":
+		s.Process = value
+	case "size":
+		if !validSize(value) {
+			return fmt.Errorf("%s: bad size %q", s.Type, value)
+		}
+		s.Size = value
+	case "delay", "jitter", "for", "offset", "jump", "every":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: bad %s: %v", s.Type, key, err)
+		}
+		switch key {
+		case "delay":
+			s.Delay = duration(d)
+		case "jitter":
+			s.Jitter = duration(d)
+		case "for":
+			s.Duration = duration(d)
+		case "offset":
+			s.Offset = duration(d)
+		case "jump":
+			s.Jump = duration(d)
+		case "every":
+			s.Every = duration(d)
+		}
+	case "drift":
+		p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil {
+			return fmt.Errorf("%s: bad drift: %v", s.Type, err)
+		}
+		s.Drift = p
+	case "loss", "duplicate", "reorder", "corrupt":
+		p, err := parsePercent(value)
+		if err != nil {
+			return fmt.Errorf("%s: bad %s: %v", s.Type, key, err)
+		}
+		switch key {
+		case "loss":
+			s.Loss = p
+		case "duplicate":
+			s.Duplicate = p
+		case "reorder":
+			s.Reorder = p
+		case "corrupt":
+			s.Corrupt = p
+		}
+	default:
+		return fmt.Errorf("%s: unknown option %q", s.Type, key)
+	}
+	return nil
+}
+
+// parsePercent parses a percentage such as 5% or 0.5. The % sign is optional.
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 100 {
+		return 0, fmt.Errorf("%v%% is not between 0%% and 100%%", p)
+	}
+	return p, nil
+}
+
+// duration is a time.Duration that is written to and read from JSON in the
+// time.ParseDuration format, e.g. "1m30s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// String returns spec in the text form read by parseFaultSpec.
+func (s *faultSpec) String() string {
+	words := []string{s.Type}
+	if len(s.Groups) > 0 {
+		words = append(words, "groups="+formatGroups(s.Groups))
+	}
+	for _, opt := range []struct{ key, value string }{
+		{"src", s.Src},
+		{"dest", s.Dest},
+		{"node", s.Node},
+		{"base", s.Base},
+		{"path", s.Path},
+		{"size", s.Size},
+		{"process", s.Process},
+	} {
+		if opt.value != "" {
+			words = append(words, opt.key+"="+opt.value)
+		}
+	}
+	for _, opt := range []struct {
+		key   string
+		value duration
+	}{
+		{"delay", s.Delay},
+		{"jitter", s.Jitter},
+		{"offset", s.Offset},
+		{"jump", s.Jump},
+		{"every", s.Every},
+		{"for", s.Duration},
+	} {
+		if opt.value != 0 {
+			words = append(words, opt.key+"="+time.Duration(opt.value).String())
+		}
+	}
+	for _, opt := range []struct {
+		key   string
+		value float64
+	}{
+		{"loss", s.Loss},
+		{"duplicate", s.Duplicate},
+		{"reorder", s.Reorder},
+		{"corrupt", s.Corrupt},
+		{"drift", s.Drift},
+	} {
+		if opt.value != 0 {
+			words = append(words, opt.key+"="+strconv.FormatFloat(opt.value, 'f', -1, 64)+"%")
+		}
+	}
+	if s.Restart != "" {
+		// the rest of the words, see procArgs
+		words = append(words, s.Restart)
+	}
+	return strings.Join(words, " ")
+}
+
+// nodes returns the names of the containers spec refers to.
+func (s *faultSpec) nodes() []string {
+	var names []string
+	for _, g := range s.Groups {
+		names = append(names, g...)
+	}
+	for _, name := range []string{s.Src, s.Dest, s.Node} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkNodes checks that the containers spec refers to exist, or for a join
+// that the container it adds does not.
+func (s *faultSpec) checkNodes(exists func(name string) bool) error {
+	for _, name := range s.nodes() {
+		if s.Type == "join" && exists(name) {
+			return fmt.Errorf("container %s already exists", name)
+		}
+		if s.Type != "join" && !exists(name) {
+			return fmt.Errorf("no container named %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *faultSpec) build() (fault, error) {
+	ft, ok := faultTypes[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown fault type %q", s.Type)
+	}
+	return ft.build(s)
+}
+
+// nodeArg is the args function of faults that target a single container
+// given as the only positional word, e.g. kill n3.
+func nodeArg(spec *faultSpec, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		spec.Node = args[0]
+	default:
+		return fmt.Errorf("%s: want one container, got %q", spec.Type, strings.Join(args, " "))
+	}
+	return nil
+}
+
+// faultFlag collects repeated -fault flags.
+type faultFlag []*faultSpec
+
+func (f *faultFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *faultFlag) Set(s string) error {
+	spec, err := parseFaultSpec(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// activeFault is a fault that has been injected and not yet healed.
+type activeFault struct {
+	id    int
+	spec  *faultSpec
+	fault fault
+	since time.Time
+
+	// deferred is set when the fault was due to be healed while a
+	// container it involves was frozen. It is healed once they all thaw.
+	deferred bool
+}
+
+// info describes af as listed to clients.
+func (af *activeFault) info() faultInfo {
+	return faultInfo{ID: af.id, Spec: af.spec, Desc: af.fault.String(), Since: af.since}
+}
+
+// faultManager keeps track of the faults currently injected into a cluster
+// so that they can be healed individually or all at once.
+//
+// exec is held while faults are injected and healed, one at a time, and so
+// guards what faults keep in the containers. mu guards the table of active
+// faults and is never held while a fault runs commands, which may take long.
+type faultManager struct {
+	exec sync.Mutex
+	mu   sync.Mutex
+
+	containers map[string]*container
+	nextID     int
+	active     map[int]*activeFault
+	closed     bool // no more faults are injected
+
+	// events receives a message for every fault injected or healed, and the
+	// membership whenever a fault changed the state of a container.
+	events      chan<- *message
+	lastMembers string
+}
+
+func newFaultManager(containers map[string]*container, events chan<- *message) *faultManager {
+	return &faultManager{
+		containers: containers,
+		nextID:     1,
+		active:     make(map[int]*activeFault),
+		events:     events,
+	}
+}
+
+// notify sends a fault event for af.
+func (m *faultManager) notify(action string, af *activeFault, err error) {
+	msg := newMessage(msgFault)
+	msg.Fault = &faultEvent{ID: af.id, Action: action, Spec: af.spec, Desc: af.fault.String()}
+	if err != nil {
+		msg.Fault.Error = err.Error()
+	}
+	m.events <- msg
+}
+
+// Inject builds and injects the fault described by spec and returns how it
+// was recorded, with its id.
+func (m *faultManager) Inject(spec *faultSpec) (faultInfo, error) {
+	f, err := spec.build()
+	if err != nil {
+		return faultInfo{}, err
+	}
+
+	m.exec.Lock()
+	defer m.exec.Unlock()
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return faultInfo{}, fmt.Errorf("shutting down")
+	}
+	if r, ok := f.(removingFault); ok {
+		for _, af := range m.info() {
+			if contains(af.Spec.nodes(), r.removes()) {
+				m.mu.Unlock()
+				return faultInfo{}, fmt.Errorf("%s is involved in active fault #%d", r.removes(), af.ID)
+			}
+		}
+	}
+	m.mu.Unlock()
+	if name := m.frozenNode(spec, f); name != "" {
+		return faultInfo{}, fmt.Errorf("%s is frozen", name)
+	}
+	if err := f.Inject(m.containers); err != nil {
+		// undo whatever part of the fault did get installed
+		f.Heal(m.containers)
+		return faultInfo{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextID
+	m.nextID++
+	af := &activeFault{id: id, spec: spec, fault: f, since: time.Now()}
+	log.Printf("[fault]: injected #%d %s %v\n", id, spec.Type, f)
+	m.notify("inject", af, nil)
+	m.sendMembers()
+	if _, ok := f.(instantFault); ok {
+		return af.info(), nil
+	}
+	m.active[id] = af
+	m.sendFaults()
+	if spec.Duration > 0 {
+		time.AfterFunc(time.Duration(spec.Duration), func() {
+			m.exec.Lock()
+			defer m.exec.Unlock()
+			m.mu.Lock()
+			_, ok := m.active[id]
+			m.mu.Unlock()
+			if !ok {
+				return // already healed by hand
+			}
+			if err := m.heal(id); err != nil {
+				log.Printf("[error]: %v\n", err)
+			}
+		})
+	}
+	return af.info(), nil
+}
+
+// frozenNode returns a frozen container that f, injected from spec, would
+// run commands in, or "" if there is none. The caller must hold m.exec.
+func (m *faultManager) frozenNode(spec *faultSpec, f fault) string {
+	if _, ok := f.(lifecycleFault); ok {
+		return ""
+	}
+	for _, name := range spec.nodes() {
+		if c, ok := m.containers[name]; ok && c.State() == stateFrozen {
+			return name
+		}
+	}
+	return ""
+}
+
+// sendMembers sends the membership if it changed since it was last sent.
+// The caller must hold m.mu.
+func (m *faultManager) sendMembers() {
+	msg := membersMessage(m.containers)
+	if s := fmt.Sprint(msg.Members); s != m.lastMembers {
+		m.lastMembers = s
+		m.events <- msg
+	}
+}
+
+// Heal heals the active fault with the given id.
+func (m *faultManager) Heal(id int) error {
+	m.exec.Lock()
+	defer m.exec.Unlock()
+	return m.heal(id)
+}
+
+// heal heals one fault, or defers healing it while a container it runs
+// commands in is frozen. Deferred faults whose containers have thawed since
+// are healed after it. The caller must hold m.exec.
+func (m *faultManager) heal(id int) error {
+	err := m.healOne(id)
+	for {
+		m.mu.Lock()
+		next := 0
+		for _, af := range m.active {
+			if af.deferred && m.frozenNode(af.spec, af.fault) == "" && (next == 0 || af.id < next) {
+				next = af.id
+			}
+		}
+		m.mu.Unlock()
+		if next == 0 {
+			return err
+		}
+		if err := m.healOne(next); err != nil {
+			log.Printf("[error]: %v\n", err)
+		}
+	}
+}
+
+// healOne heals or defers one fault. The caller must hold m.exec.
+func (m *faultManager) healOne(id int) error {
+	m.mu.Lock()
+	af, ok := m.active[id]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("no active fault #%d", id)
+	}
+	if name := m.frozenNode(af.spec, af.fault); name != "" {
+		if !af.deferred {
+			af.deferred = true
+			log.Printf("[fault]: healing #%d %s %v once %s thaws\n", id, af.spec.Type, af.fault, name)
+		}
+		m.mu.Unlock()
+		return nil
+	}
+	delete(m.active, id)
+	m.mu.Unlock()
+
+	err := af.fault.Heal(m.containers)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.sendFaults()
+	if err != nil {
+		m.notify("heal", af, err)
+		m.sendMembers()
+		return fmt.Errorf("healing #%d %s: %v", id, af.spec.Type, err)
+	}
+	log.Printf("[fault]: healed #%d %s %v\n", id, af.spec.Type, af.fault)
+	m.notify("heal", af, nil)
+	m.sendMembers()
+	return nil
+}
+
+// HealAll heals every active fault, newest first, logging any errors. Faults
+// involving a container that stays frozen are left deferred.
+func (m *faultManager) HealAll() {
+	m.exec.Lock()
+	defer m.exec.Unlock()
+	m.mu.Lock()
+	var ids []int
+	for id := range m.active {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	for _, id := range ids {
+		m.mu.Lock()
+		_, ok := m.active[id]
+		m.mu.Unlock()
+		if !ok {
+			continue // healed after a deferred one
+		}
+		if err := m.heal(id); err != nil {
+			log.Printf("[error]: %v\n", err)
+		}
+	}
+}
+
+// Close heals every active fault and refuses to inject any more.
+func (m *faultManager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.HealAll()
+}
+
+// Info describes the active faults, oldest first.
+func (m *faultManager) Info() []faultInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.info()
+}
+
+// info describes the active faults. The caller must hold m.mu.
+func (m *faultManager) info() []faultInfo {
+	var ids []int
+	for id := range m.active {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var info []faultInfo
+	for _, id := range ids {
+		info = append(info, m.active[id].info())
+	}
+	return info
+}
+
+// sendFaults sends the active faults. The caller must hold m.mu.
+func (m *faultManager) sendFaults() {
+	msg := newMessage(msgFaults)
+	msg.Faults = m.info()
+	m.events <- msg
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var parseFaultSpecTests = []struct {
+	in   string
+	want *faultSpec // nil if in is invalid
+}{
+	{"partition {n0,n1}|{n2,n3,n4}", &faultSpec{Type: "partition", Groups: [][]string{{"n0", "n1"}, {"n2", "n3", "n4"}}}},
+	{"partition groups=n0|n1 for=30s", &faultSpec{Type: "partition", Groups: [][]string{{"n0"}, {"n1"}}, Duration: duration(30 * time.Second)}},
+	{"netem n0 n1 delay=100ms jitter=10ms loss=1%", &faultSpec{Type: "netem", Src: "n0", Dest: "n1",
+		Delay: duration(100 * time.Millisecond), Jitter: duration(10 * time.Millisecond), Loss: 1}},
+	{"netem src=n0 dest=n1 corrupt=0.5", &faultSpec{Type: "netem", Src: "n0", Dest: "n1", Corrupt: 0.5}},
+	{"drop n0 n1", &faultSpec{Type: "drop", Src: "n0", Dest: "n1"}},
+	{"kill n2", &faultSpec{Type: "kill", Node: "n2"}},
+	{"skew n2 offset=-30s", &faultSpec{Type: "skew", Node: "n2", Offset: duration(-30 * time.Second)}},
+	{"skew n2 drift=0.5% jump=5s every=1m", &faultSpec{Type: "skew", Node: "n2", Drift: 0.5,
+		Jump: duration(5 * time.Second), Every: duration(time.Minute)}},
+	{"diskfull n2 /data size=1G", &faultSpec{Type: "diskfull", Node: "n2", Path: "/data", Size: "1G"}},
+	{"join n5 base=other", &faultSpec{Type: "join", Node: "n5", Base: "other"}},
+	{"", nil},
+	{"flood n0", nil},
+	{"kill n0 n1", nil},
+	{"drop n0", nil},
+	{"netem n0 n1 loss=101%", nil},
+	{"netem n0 n1 delay=soon", nil},
+	{"diskfull n2 /data size=lots", nil},
+	{"pause n0 colour=red", nil},
+	{"partition {n0}|{}", nil},
+}
+
+func TestParseFaultSpec(t *testing.T) {
+	for _, tt := range parseFaultSpecTests {
+		spec, err := parseFaultSpec(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseFaultSpec(%q) = %v, want an error", tt.in, spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFaultSpec(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec, tt.want) {
+			t.Errorf("parseFaultSpec(%q) = %#v, want %#v", tt.in, spec, tt.want)
+		}
+	}
+}
+
+// newFakeCluster starts count containers named n0, n1, ... on a fake
+// runtime.
+func newFakeCluster(t *testing.T, count int) (*fakeRuntime, map[string]*container) {
+	rt := newFakeRuntime()
+	containers := make(map[string]*container)
+	for _, name := range containerNames("n", count) {
+		c := &container{name: name, rt: rt}
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		containers[name] = c
+	}
+	return rt, containers
+}
+
+// A fault that runs commands in a container waits for it to thaw, instead
+// of blocking on it while the fault manager is locked.
+func TestFaultManagerFrozen(t *testing.T) {
+	_, containers := newFakeCluster(t, 2)
+	events := make(chan *message, 100)
+	m := newFaultManager(containers, events)
+	inject := func(s string) (int, error) {
+		spec, err := parseFaultSpec(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := m.Inject(spec)
+		return info.ID, err
+	}
+
+	delay, err := inject("netem n0 n1 delay=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pause, err := inject("pause n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inject("drop n0 n1"); err == nil {
+		t.Errorf("injected a drop into a frozen container")
+	}
+	if err := m.Heal(delay); err != nil {
+		t.Errorf("healing the delay: %v", err)
+	}
+	if got := len(m.Info()); got != 2 {
+		t.Errorf("%d active faults while n0 is frozen, want 2", got)
+	}
+
+	// thawing n0 heals the delay too
+	if err := m.Heal(pause); err != nil {
+		t.Fatalf("healing the pause: %v", err)
+	}
+	if info := m.Info(); len(info) != 0 {
+		t.Errorf("active faults after thawing n0: %v", info)
+	}
+	if len(containers["n0"].netemBands) != 0 {
+		t.Errorf("netem bands left on n0: %v", containers["n0"].netemBands)
+	}
+}
+
+// Healing a fault whose rules went with a reboot of the container succeeds.
+func TestFaultManagerReboot(t *testing.T) {
+	_, containers := newFakeCluster(t, 3)
+	m := newFaultManager(containers, make(chan *message, 100))
+	for _, s := range []string{"partition {n0}|{n1,n2}", "drop n2 n1", "kill n2"} {
+		spec, err := parseFaultSpec(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Inject(spec); err != nil {
+			t.Fatalf("injecting %s: %v", s, err)
+		}
+	}
+	// heal the kill first, then the faults n2 lost by booting again
+	for _, id := range []int{3, 1, 2} {
+		if err := m.Heal(id); err != nil {
+			t.Errorf("healing #%d: %v", id, err)
+		}
+	}
+	if containers["n2"].State() != stateRunning {
+		t.Errorf("n2 is %s after healing the kill", containers["n2"].State())
+	}
+}
+
+func TestFaultManagerSkewTwice(t *testing.T) {
+	_, containers := newFakeCluster(t, 2)
+	m := newFaultManager(containers, make(chan *message, 100))
+	inject := func(s string) (int, error) {
+		spec, err := parseFaultSpec(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := m.Inject(spec)
+		return info.ID, err
+	}
+
+	first, err := inject("skew n0 offset=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inject("skew n0 offset=-1m"); err == nil {
+		t.Errorf("skewed n0 twice")
+	}
+	if _, err := inject("skew n1 offset=-1m"); err != nil {
+		t.Errorf("skewing n1 next to n0: %v", err)
+	}
+	if err := m.Heal(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inject("skew n0 offset=-1m"); err != nil {
+		t.Errorf("skewing n0 again after healing: %v", err)
+	}
+}
+
+func TestFaultManagerInjectInfo(t *testing.T) {
+	_, containers := newFakeCluster(t, 1)
+	m := newFaultManager(containers, make(chan *message, 100))
+	spec, err := parseFaultSpec("procstop n0 postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := m.Inject(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the description names the pids found when injecting
+	if want := "n0:postgres SIGSTOP pid 100"; info.Desc != want {
+		t.Errorf("injected %q, want %q", info.Desc, want)
+	}
+	if active := m.Info(); len(active) != 1 || active[0] != info {
+		t.Errorf("active faults %v, want %v", active, info)
+	}
+}
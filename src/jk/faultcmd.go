@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var faultAddr string
+
+func init() {
+	cmdFault.Run = runFault
+	cmdFault.Flag.StringVar(&faultAddr, "addr", defaultHTTPAddr, "")
+	cmdFaultPartition.Run = runFaultPartition
+	cmdFaultDelay.Run = runFaultDelay
+	cmdFaultKill.Run = runFaultKill
+	cmdFaultInject.Run = runFaultInject
+	cmdFaultHeal.Run = runFaultHeal
+	cmdFaultList.Run = runFaultList
+	cmdFaultClear.Run = runFaultClear
+}
+
+var cmdFault = &Command{
+	UsageLine:   "fault [-addr addr] command [arguments]",
+	Short:       "inject and heal faults in a running daemon",
+	CustomFlags: true,
+	Long: `
+fault talks to a running daemon over its control API to inject and heal
+faults by hand, without writing a scenario first.
+
+the commands are:
+
+	partition groups [for=duration]
+		split the cluster, e.g. jk fault partition '{n0,n1}|{n2,n3,n4}'
+
+	delay src dest [delay] [jitter=d] [loss=p] [for=duration]
+		degrade the link from src to dest with netem,
+		e.g. jk fault delay n0 n1 200ms jitter=20ms for=1m
+
+	kill node [for=duration]
+		kill a container. it is booted again when the fault heals.
+
+	inject spec
+		inject any fault given as a text spec, as taken by daemon -fault,
+		e.g. jk fault inject pause n3 for=30s
+
+	heal id...
+		heal the faults with the given ids.
+
+	list
+		list the active faults.
+
+	clear
+		heal every active fault.
+
+fault supports the following flags:
+
+	-addr addr
+		the daemon's HTTP address, as set with daemon -http. defaults to
+		localhost:31416.
+`,
+}
+
+// faultCommands are the commands of fault, found by name like the top
+// level commands.
+var faultCommands = []*Command{
+	cmdFaultPartition,
+	cmdFaultDelay,
+	cmdFaultKill,
+	cmdFaultInject,
+	cmdFaultHeal,
+	cmdFaultList,
+	cmdFaultClear,
+}
+
+var cmdFaultPartition = &Command{
+	UsageLine: "partition groups [for=duration]",
+	Short:     "partition the cluster",
+	Long:      "partition splits the cluster into groups that cannot reach each other, e.g. '{n0,n1}|{n2,n3,n4}'.",
+}
+
+var cmdFaultDelay = &Command{
+	UsageLine: "delay src dest [delay] [jitter=d] [loss=p] [for=duration]",
+	Short:     "degrade a link",
+	Long:      "delay degrades the link from src to dest. it takes the options of netem faults.",
+}
+
+var cmdFaultKill = &Command{
+	UsageLine: "kill node [for=duration]",
+	Short:     "kill a container",
+	Long:      "kill kills a container until the fault is healed.",
+}
+
+var cmdFaultInject = &Command{
+	UsageLine: "inject spec",
+	Short:     "inject any fault",
+	Long:      "inject injects the fault described by a text spec, as taken by daemon -fault.",
+}
+
+var cmdFaultHeal = &Command{
+	UsageLine: "heal id...",
+	Short:     "heal faults",
+	Long:      "heal heals the active faults with the given ids, as printed by list.",
+}
+
+var cmdFaultList = &Command{
+	UsageLine: "list",
+	Short:     "list active faults",
+	Long:      "list prints the active faults.",
+}
+
+var cmdFaultClear = &Command{
+	UsageLine: "clear",
+	Short:     "heal every fault",
+	Long:      "clear heals every active fault.",
+}
+
+func runFault(c *Command, args []string) {
+	c.Flag.Parse(args)
+	args = c.Flag.Args()
+	if len(args) == 0 {
+		c.Usage()
+	}
+	for _, cmd := range faultCommands {
+		if cmd.Name() == args[0] {
+			invokeCommand(cmd, args)
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "jk fault: unknown command %q\nRun 'jk help fault' for usage.\n", args[0])
+	setExitStatus(2)
+}
+
+func runFaultPartition(c *Command, args []string) {
+	if len(args) == 0 {
+		c.Usage()
+	}
+	injectFault("partition " + strings.Join(args, " "))
+}
+
+func runFaultDelay(c *Command, args []string) {
+	if len(args) < 2 {
+		c.Usage()
+	}
+	words := []string{"netem", args[0], args[1]}
+	for _, a := range args[2:] {
+		if _, err := time.ParseDuration(a); err == nil {
+			a = "delay=" + a
+		}
+		words = append(words, a)
+	}
+	injectFault(strings.Join(words, " "))
+}
+
+func runFaultKill(c *Command, args []string) {
+	if len(args) == 0 {
+		c.Usage()
+	}
+	injectFault("kill " + strings.Join(args, " "))
+}
+
+func runFaultInject(c *Command, args []string) {
+	if len(args) == 0 {
+		c.Usage()
+	}
+	injectFault(strings.Join(args, " "))
+}
+
+// injectFault asks the daemon to inject the fault with the given text spec.
+func injectFault(spec string) {
+	if _, err := parseFaultSpec(spec); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	var f faultInfo
+	if err := callAPI("POST", "/api/faults", strings.NewReader(spec), &f); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	fmt.Printf("injected #%d %s %s\n", f.ID, f.Spec.Type, f.Desc)
+}
+
+func runFaultHeal(c *Command, args []string) {
+	if len(args) == 0 {
+		c.Usage()
+	}
+	for _, id := range args {
+		if err := callAPI("DELETE", "/api/faults/"+id, nil, nil); err != nil {
+			log.Printf("[error]: %v\n", err)
+			setExitStatus(1)
+			continue
+		}
+		fmt.Printf("healed #%s\n", id)
+	}
+}
+
+func runFaultList(c *Command, args []string) {
+	if len(args) != 0 {
+		c.Usage()
+	}
+	var faults []faultInfo
+	if err := callAPI("GET", "/api/faults", nil, &faults); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	printFaults(faults)
+}
+
+func runFaultClear(c *Command, args []string) {
+	if len(args) != 0 {
+		c.Usage()
+	}
+	var faults []faultInfo
+	if err := callAPI("DELETE", "/api/faults", nil, &faults); err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	if len(faults) > 0 {
+		fmt.Printf("some faults could not be healed:\n")
+		printFaults(faults)
+		setExitStatus(1)
+	}
+}
+
+func printFaults(faults []faultInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tAGE\tTYPE\tFAULT\tSPEC\n")
+	for _, f := range faults {
+		fmt.Fprintf(w, "%d\t%v\t%s\t%s\t%v\n", f.ID, time.Since(f.Since).Truncate(time.Second), f.Spec.Type, f.Desc, f.Spec)
+	}
+	w.Flush()
+}
+
+// callAPI makes a request to the daemon's control API and decodes the reply
+// into out, unless it is nil.
+func callAPI(method, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, "http://"+faultAddr+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach daemon: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("daemon replied %s", resp.Status)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
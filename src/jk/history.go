@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// A history file records everything that happened during a run so it can be
+// analyzed after the daemon has exited. It holds one protocol message per
+// line, exactly as sent to watch: every run appended to the file starts with
+// a hello carrying the protocol version, followed by the membership and then
+// every probe result, fault event and membership change in the order the
+// daemon saw them.
+type historyLog struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// historyPath is the -history flag shared by the commands that run containers.
+var historyPath string
+
+func addHistoryFlag(f *flag.FlagSet) {
+	f.StringVar(&historyPath, "history", "", "")
+}
+
+// historyFlagDoc documents -history in the Long text of those commands.
+const historyFlagDoc = `
+	-history file
+		append every probe result and fault event to file. see 'jk help history'.
+`
+
+// openHistory opens the history file named by -history for appending, or
+// returns nil if there is none.
+func openHistory() *historyLog {
+	if historyPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(historyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("[error]: could not open history: %v\n", err)
+	}
+	h := &historyLog{f: f, enc: json.NewEncoder(f)}
+	hello := newMessage(msgHello)
+	hello.Version = protocolVersion
+	h.Record(hello)
+	return h
+}
+
+// Record appends m to the history. A nil history records nothing.
+func (h *historyLog) Record(m *message) {
+	if h == nil {
+		return
+	}
+	if err := h.enc.Encode(m); err != nil {
+		log.Printf("[error]: could not write history: %v\n", err)
+	}
+}
+
+func (h *historyLog) Close() {
+	if h != nil {
+		h.f.Close()
+	}
+}
+
+// readHistory calls fn for every message in the history read from r.
+// Histories of older protocol versions are read too; they only lack what
+// later versions added.
+func readHistory(r io.Reader, fn func(m *message) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		m := &message{}
+		if err := dec.Decode(m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if m.Type == msgHello && (m.Version < 1 || m.Version > protocolVersion) {
+			return fmt.Errorf("history is protocol version %d, jk reads versions up to %d", m.Version, protocolVersion)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+var (
+	historySrc     string
+	historyDest    string
+	historyNode    string
+	historyProbe   string
+	historyType    string
+	historySince   string
+	historyUntil   string
+	historySummary bool
+)
+
+func init() {
+	cmdHistory.Run = runHistory
+	cmdHistory.Flag.StringVar(&historySrc, "src", "", "")
+	cmdHistory.Flag.StringVar(&historyDest, "dest", "", "")
+	cmdHistory.Flag.StringVar(&historyNode, "node", "", "")
+	cmdHistory.Flag.StringVar(&historyProbe, "probe", "", "")
+	cmdHistory.Flag.StringVar(&historyType, "type", "", "")
+	cmdHistory.Flag.StringVar(&historySince, "since", "", "")
+	cmdHistory.Flag.StringVar(&historyUntil, "until", "", "")
+	cmdHistory.Flag.BoolVar(&historySummary, "summary", false, "")
+}
+
+var cmdHistory = &Command{
+	UsageLine: "history [flags] file",
+	Short:     "print or summarize a recorded run",
+	Long: `
+history reads a history file written by daemon, run or chaos with -history
+and prints the events in it, one per line, with their time and offset from
+the start of the run.
+
+a history file holds one JSON object per line in the same format daemon
+sends to watch. each run appended to the file starts with a "hello" record
+carrying the protocol version, followed by a "members" record and then
+"probe", "fault", "members" and "op" records as they happened, with a "latency"
+record holding the percentiles of every link every few seconds. "op"
+records are the operations of a client workload, see 'jk help check'.
+
+history supports the following flags:
+
+	-src name, -dest name
+		only show probes from or to the named container, and the latency
+		of those links.
+
+	-node name
+		only show records involving the named container: probes from or
+		to it and the latency of those links, faults involving it, its
+		operations, and its entry in membership records.
+
+	-probe name
+		only show results and latency of the named probe, and no fault
+		or membership records.
+
+	-type t
+		only show records of type t: probe, fault, members, latency or op.
+
+	-since t, -until t
+		only show records in a time window. t is either an offset from the
+		start of the run, such as 1m30s, or an RFC 3339 time.
+
+	-summary
+		instead of listing the records, summarize each run in the file:
+		success ratio and latency of each probe of each link, and when
+		each fault was active.
+`,
+}
+
+func runHistory(c *Command, args []string) {
+	if len(args) != 1 {
+		c.Usage()
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	defer f.Close()
+
+	var start time.Time
+	var sum *historySummaryStats
+	if historySummary {
+		sum = newHistorySummary()
+	}
+	err = readHistory(f, func(m *message) error {
+		if m.Type == msgHello {
+			start = m.Time
+			if sum != nil {
+				// fault ids start again from 1 in every run
+				if !sum.first.IsZero() {
+					sum.print(os.Stdout)
+					fmt.Println()
+				}
+				sum = newHistorySummary()
+			} else {
+				fmt.Printf("%s run started\n", m.Time.Format(time.RFC3339))
+			}
+			return nil
+		}
+		if start.IsZero() {
+			start = m.Time
+		}
+		ok, err := historyMatch(m, start)
+		if err != nil || !ok {
+			return err
+		}
+		if sum != nil {
+			sum.add(m)
+			return nil
+		}
+		fmt.Printf("%s %10s  %-7s %v\n", m.Time.Format("15:04:05.000"),
+			"+"+m.Time.Sub(start).Truncate(time.Millisecond).String(), m.Type, m)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("[error]: %s: %v\n", args[0], err)
+	}
+	if sum != nil && !sum.first.IsZero() {
+		sum.print(os.Stdout)
+	}
+}
+
+// historyMatch reports whether m passes the filter flags. Latency, members
+// and faults records are trimmed to the links, containers and faults that
+// pass. start is the beginning of the run m belongs to.
+func historyMatch(m *message, start time.Time) (bool, error) {
+	if historyType != "" && m.Type != historyType {
+		return false, nil
+	}
+	if historySince != "" {
+		since, err := historyTime(historySince, start)
+		if err != nil {
+			return false, err
+		}
+		if m.Time.Before(since) {
+			return false, nil
+		}
+	}
+	if historyUntil != "" {
+		until, err := historyTime(historyUntil, start)
+		if err != nil {
+			return false, err
+		}
+		if m.Time.After(until) {
+			return false, nil
+		}
+	}
+	switch m.Type {
+	case msgProbe:
+		return historyLink(m.Src, m.Dest, m.Probe), nil
+	case msgLatency:
+		var kept []linkLatency
+		for _, l := range m.Latencies {
+			if historyLink(l.Src, l.Dest, l.Probe) {
+				kept = append(kept, l)
+			}
+		}
+		m.Latencies = kept
+		return len(kept) > 0, nil
+	}
+
+	// the other records are not about links or probes
+	if historySrc != "" || historyDest != "" || historyProbe != "" {
+		return false, nil
+	}
+	if historyNode == "" {
+		return true, nil
+	}
+	switch m.Type {
+	case msgFault:
+		return contains(m.Fault.Spec.nodes(), historyNode), nil
+	case msgFaults:
+		var kept []faultInfo
+		for _, f := range m.Faults {
+			if contains(f.Spec.nodes(), historyNode) {
+				kept = append(kept, f)
+			}
+		}
+		m.Faults = kept
+		return len(kept) > 0, nil
+	case msgMembers:
+		var kept []member
+		for _, c := range m.Members {
+			if c.Name == historyNode {
+				kept = append(kept, c)
+			}
+		}
+		m.Members = kept
+		return len(kept) > 0, nil
+	case msgOp:
+		return m.Op.Node == historyNode, nil
+	}
+	return true, nil
+}
+
+// historyLink reports whether the results of probe on the link from src to
+// dest pass the filter flags.
+func historyLink(src, dest, probe string) bool {
+	if historySrc != "" && src != historySrc || historyDest != "" && dest != historyDest {
+		return false
+	}
+	if historyNode != "" && src != historyNode && dest != historyNode {
+		return false
+	}
+	return historyProbe == "" || probe == historyProbe
+}
+
+// historyTime parses an offset from start or an absolute time.
+func historyTime(s string, start time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return start.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("%q is neither an offset nor an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// historySummaryStats accumulates the summary printed by history -summary.
+type historySummaryStats struct {
+	first, last time.Time
+	counts      map[string]int
+	links       map[latencyKey]*linkStats
+	faults      []*faultSpan
+	open        map[int]*faultSpan
+}
+
+// linkStats summarizes one probe over one link.
+type linkStats struct {
+	probes, ok int
+	total, max time.Duration
+}
+
+// faultSpan is when a fault was active.
+type faultSpan struct {
+	id               int
+	desc             string
+	injected, healed time.Time
+}
+
+func newHistorySummary() *historySummaryStats {
+	return &historySummaryStats{
+		counts: make(map[string]int),
+		links:  make(map[latencyKey]*linkStats),
+		open:   make(map[int]*faultSpan),
+	}
+}
+
+func (s *historySummaryStats) add(m *message) {
+	if s.first.IsZero() {
+		s.first = m.Time
+	}
+	s.last = m.Time
+	s.counts[m.Type]++
+	switch m.Type {
+	case msgProbe:
+		k := latencyKey{m.Src, m.Dest, m.Probe}
+		l := s.links[k]
+		if l == nil {
+			l = &linkStats{}
+			s.links[k] = l
+		}
+		l.probes++
+		if m.OK {
+			l.ok++
+			l.total += time.Duration(m.Latency)
+			if time.Duration(m.Latency) > l.max {
+				l.max = time.Duration(m.Latency)
+			}
+		}
+	case msgFault:
+		switch m.Fault.Action {
+		case "inject":
+			span := &faultSpan{id: m.Fault.ID, desc: m.Fault.Spec.Type + " " + m.Fault.Desc, injected: m.Time}
+			s.faults = append(s.faults, span)
+			s.open[m.Fault.ID] = span
+		case "heal":
+			if span, ok := s.open[m.Fault.ID]; ok {
+				span.healed = m.Time
+				delete(s.open, m.Fault.ID)
+			}
+		}
+	}
+}
+
+func (s *historySummaryStats) print(w io.Writer) {
+	fmt.Fprintf(w, "%s to %s (%v)\n", s.first.Format(time.RFC3339), s.last.Format(time.RFC3339),
+		s.last.Sub(s.first).Truncate(time.Second))
+	fmt.Fprintf(w, "%d probes, %d fault events, %d membership records\n\n",
+		s.counts[msgProbe], s.counts[msgFault], s.counts[msgMembers])
+
+	var links []latencyKey
+	for k := range s.links {
+		links = append(links, k)
+	}
+	sort.Sort(byLatencyKey(links))
+	fmt.Fprintf(w, "%-28s %8s %8s %10s %10s\n", "link and probe", "probes", "ok", "mean", "max")
+	for _, l := range links {
+		st := s.links[l]
+		var mean time.Duration
+		if st.ok > 0 {
+			mean = st.total / time.Duration(st.ok)
+		}
+		fmt.Fprintf(w, "%-28s %8d %7.1f%% %10v %10v\n", l.src+" -> "+l.dest+" "+l.probe, st.probes,
+			100*float64(st.ok)/float64(st.probes), mean.Truncate(time.Microsecond), st.max.Truncate(time.Microsecond))
+	}
+
+	if len(s.faults) > 0 {
+		fmt.Fprintf(w, "\nfaults:\n")
+	}
+	for _, f := range s.faults {
+		healed := "never healed"
+		if !f.healed.IsZero() {
+			healed = fmt.Sprintf("healed after %v", f.healed.Sub(f.injected).Truncate(time.Millisecond))
+		}
+		fmt.Fprintf(w, "  #%-3d +%-10v %s, %s\n", f.id, f.injected.Sub(s.first).Truncate(time.Millisecond), f.desc, healed)
+	}
+}
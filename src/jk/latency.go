@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// latencyWindow is how many of the latest successful probes of a link its
+// percentiles are computed over.
+const latencyWindow = 100
+
+// latencyReportInterval is how often the daemon sends the percentiles of
+// every link to watch.
+const latencyReportInterval = 5 * time.Second
+
+// latencyKey identifies the samples of one probe over one link.
+type latencyKey struct {
+	src, dest, probe string
+}
+
+// latencyRing holds the round trip times of the latest successful probes of
+// one link, oldest overwritten first.
+type latencyRing struct {
+	samples []time.Duration
+	next    int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	if len(r.samples) < latencyWindow {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencyWindow
+}
+
+// latencyStats keeps a rolling window of latencies per link. It is only used
+// from the goroutine in startLog that sees every probe result.
+type latencyStats struct {
+	links map[latencyKey]*latencyRing
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{links: make(map[latencyKey]*latencyRing)}
+}
+
+// add records the latency of a successful probe.
+func (s *latencyStats) add(m *message) {
+	if !m.OK {
+		return
+	}
+	k := latencyKey{m.Src, m.Dest, m.Probe}
+	r := s.links[k]
+	if r == nil {
+		r = &latencyRing{}
+		s.links[k] = r
+	}
+	r.add(time.Duration(m.Latency))
+}
+
+// message returns the percentiles of every link as a latency message.
+func (s *latencyStats) message() *message {
+	m := newMessage(msgLatency)
+	for k, r := range s.links {
+		sorted := append([]time.Duration(nil), r.samples...)
+		sort.Sort(byDuration(sorted))
+		m.Latencies = append(m.Latencies, linkLatency{
+			Src:     k.src,
+			Dest:    k.dest,
+			Probe:   k.probe,
+			Samples: len(sorted),
+			P50:     duration(percentile(sorted, 50)),
+			P95:     duration(percentile(sorted, 95)),
+			P99:     duration(percentile(sorted, 99)),
+			Max:     duration(sorted[len(sorted)-1]),
+		})
+	}
+	sort.Sort(byLinkLatency(m.Latencies))
+	return m
+}
+
+// percentile returns the pth percentile of sorted by the nearest rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+type byLinkLatency []linkLatency
+
+func (l byLinkLatency) Len() int      { return len(l) }
+func (l byLinkLatency) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byLinkLatency) Less(i, j int) bool {
+	if l[i].Src != l[j].Src {
+		return lessName(l[i].Src, l[j].Src)
+	}
+	if l[i].Dest != l[j].Dest {
+		return lessName(l[i].Dest, l[j].Dest)
+	}
+	return l[i].Probe < l[j].Probe
+}
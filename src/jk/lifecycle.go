@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+)
+
+func init() {
+	faultTypes["kill"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("kill needs a node")
+			}
+			return &kill{node: spec.Node}, nil
+		},
+	}
+	faultTypes["restart"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("restart needs a node")
+			}
+			return &restart{node: spec.Node}, nil
+		},
+	}
+	faultTypes["pause"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("pause needs a node")
+			}
+			return &pause{node: spec.Node}, nil
+		},
+	}
+}
+
+// kill stops a container without a clean shutdown. Healing starts it again.
+type kill struct {
+	node   string
+	killed bool
+}
+
+func (k *kill) Inject(containers map[string]*container) error {
+	c, ok := containers[k.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", k.node)
+	}
+	prev := c.State()
+	c.setState(stateStopping)
+	if err := c.rt.Kill(c.name); err != nil {
+		c.setState(prev)
+		return fmt.Errorf("could not kill %s: %v", c.name, err)
+	}
+	k.killed = true
+	// the qdiscs of any netem faults went down with the container
+	c.netemBands = nil
+	err := c.rt.Wait(c.name, "STOPPED", stateTimeout)
+	c.setState(stateStopped)
+	return err
+}
+
+func (k *kill) Heal(containers map[string]*container) error {
+	c, ok := containers[k.node]
+	if !ok || !k.killed {
+		return nil
+	}
+	return boot(c)
+}
+
+// boot starts c again after a kill or restart.
+func boot(c *container) error {
+	c.setState(stateStarting)
+	if err := c.rt.Start(c.name); err != nil {
+		c.setState(stateStopped)
+		return fmt.Errorf("could not start %s: %v", c.name, err)
+	}
+	if err := c.rt.Wait(c.name, "RUNNING", stateTimeout); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.boots++
+	c.mu.Unlock()
+	c.setState(stateRunning)
+	c.findIp()
+	return nil
+}
+
+func (k *kill) lifecycle() {}
+
+func (k *kill) String() string {
+	return k.node
+}
+
+// restart shuts a container down cleanly and boots it again straight away.
+// There is nothing to heal.
+type restart struct {
+	node string
+}
+
+func (r *restart) Inject(containers map[string]*container) error {
+	c, ok := containers[r.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", r.node)
+	}
+	c.Stop()
+	c.netemBands = nil
+	return boot(c)
+}
+
+func (r *restart) Heal(containers map[string]*container) error {
+	return nil
+}
+
+func (r *restart) instant() {}
+
+func (r *restart) lifecycle() {}
+
+func (r *restart) String() string {
+	return r.node
+}
+
+// pause freezes every process in a container, leaving it alive but
+// unresponsive, until it is healed.
+type pause struct {
+	node   string
+	frozen bool
+}
+
+func (p *pause) Inject(containers map[string]*container) error {
+	c, ok := containers[p.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", p.node)
+	}
+	if err := c.rt.Freeze(c.name); err != nil {
+		return fmt.Errorf("could not freeze %s: %v", c.name, err)
+	}
+	p.frozen = true
+	c.setState(stateFrozen)
+	return nil
+}
+
+func (p *pause) Heal(containers map[string]*container) error {
+	c, ok := containers[p.node]
+	if !ok || !p.frozen {
+		return nil
+	}
+	if err := c.rt.Unfreeze(c.name); err != nil {
+		return fmt.Errorf("could not unfreeze %s: %v", c.name, err)
+	}
+	c.setState(stateRunning)
+	return nil
+}
+
+func (p *pause) lifecycle() {}
+
+func (p *pause) String() string {
+	return p.node
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// historyOp is a register operation as seen by the linearizability checker:
+// an invocation together with its completion.
+type historyOp struct {
+	op   *operation // the completion, or the invocation if there is none
+	call time.Time
+	ret  time.Time
+
+	// pending operations ended in info or never completed. They may have
+	// taken effect at any time after their call, or not at all.
+	pending bool
+}
+
+// historyOps pairs the invocations and completions of the ops in a run.
+// Failed operations did not happen and reads that did not complete changed
+// nothing, so both are left out.
+func historyOps(msgs []*message) []*historyOp {
+	var ops []*historyOp
+	invoked := make(map[int]*message)
+	for _, m := range msgs {
+		p := m.Op.Process
+		if m.Op.Type == "invoke" {
+			invoked[p] = m
+			continue
+		}
+		inv, ok := invoked[p]
+		if !ok {
+			continue
+		}
+		delete(invoked, p)
+		switch m.Op.Type {
+		case "ok":
+			ops = append(ops, &historyOp{op: m.Op, call: inv.Time, ret: m.Time})
+		case "info":
+			if m.Op.F != "read" {
+				ops = append(ops, &historyOp{op: inv.Op, call: inv.Time, pending: true})
+			}
+		}
+	}
+	for _, inv := range invoked {
+		if inv.Op.F != "read" {
+			ops = append(ops, &historyOp{op: inv.Op, call: inv.Time, pending: true})
+		}
+	}
+	sort.Sort(byCall(ops))
+	return ops
+}
+
+// register is the state of the register model.
+type register struct {
+	set   bool
+	value int
+}
+
+// step applies op to r and reports whether the model allows it.
+func (r register) step(op *operation) (register, bool) {
+	switch op.F {
+	case "read":
+		if op.Value == nil {
+			return r, !r.set
+		}
+		return r, r.set && r.value == *op.Value
+	case "write":
+		return register{true, *op.Value}, true
+	case "cas":
+		if !r.set || r.value != *op.Old {
+			return r, false
+		}
+		return register{true, *op.Value}, true
+	}
+	return r, false
+}
+
+// entry is a call or return in the doubly linked list searched by
+// linearizable.
+type entry struct {
+	id         int
+	call       bool
+	time       time.Time
+	match      *entry // the return of a call, or nil if it is pending
+	prev, next *entry
+}
+
+type byEntryTime []*entry
+
+func (e byEntryTime) Len() int      { return len(e) }
+func (e byEntryTime) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byEntryTime) Less(i, j int) bool {
+	if !e[i].time.Equal(e[j].time) {
+		return e[i].time.Before(e[j].time)
+	}
+	// operations that end as another starts may still overlap
+	return e[i].call && !e[j].call
+}
+
+// linearizable reports whether some order of ops that respects real time
+// explains every read of the register, using the algorithm of Wing and Gong
+// as improved by Lowe: operations are linearized in turn as long as the
+// model allows them, backtracking whenever an operation returns before it
+// could be linearized, and remembering every set of linearized operations
+// and state that has been tried before. Pending operations need not be
+// linearized at all.
+func linearizable(ops []*historyOp) bool {
+	var entries []*entry
+	for i, op := range ops {
+		call := &entry{id: i, call: true, time: op.call}
+		entries = append(entries, call)
+		if !op.pending {
+			call.match = &entry{id: i, time: op.ret}
+			entries = append(entries, call.match)
+		}
+	}
+	sort.Sort(byEntryTime(entries))
+	head := &entry{}
+	prev := head
+	for _, e := range entries {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	lift := func(e *entry) {
+		e.prev.next = e.next
+		if e.next != nil {
+			e.next.prev = e.prev
+		}
+		if m := e.match; m != nil {
+			m.prev.next = m.next
+			if m.next != nil {
+				m.next.prev = m.prev
+			}
+		}
+	}
+	unlift := func(e *entry) {
+		if m := e.match; m != nil {
+			m.prev.next = m
+			if m.next != nil {
+				m.next.prev = m
+			}
+		}
+		e.prev.next = e
+		if e.next != nil {
+			e.next.prev = e
+		}
+	}
+
+	type frame struct {
+		e     *entry
+		state register
+	}
+	var stack []frame
+	linearized := make([]uint64, (len(ops)+63)/64)
+	seen := make(map[string]bool)
+	key := func(r register) string {
+		b := make([]byte, 8*len(linearized)+9)
+		for i, w := range linearized {
+			binary.LittleEndian.PutUint64(b[8*i:], w)
+		}
+		if r.set {
+			b[8*len(linearized)] = 1
+			binary.LittleEndian.PutUint64(b[8*len(linearized)+1:], uint64(r.value))
+		}
+		return string(b)
+	}
+
+	var state register
+	e := head.next
+	for e != nil {
+		if !e.call {
+			// e returned before it could be linearized: undo the last
+			// choice and try the next operation after it
+			if len(stack) == 0 {
+				return false
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = top.state
+			linearized[top.e.id/64] &^= 1 << uint(top.e.id%64)
+			unlift(top.e)
+			e = top.e.next
+			continue
+		}
+		if next, ok := state.step(ops[e.id].op); ok {
+			linearized[e.id/64] |= 1 << uint(e.id%64)
+			if k := key(next); !seen[k] {
+				seen[k] = true
+				stack = append(stack, frame{e, state})
+				state = next
+				lift(e)
+				e = head.next
+				continue
+			}
+			linearized[e.id/64] &^= 1 << uint(e.id%64)
+		}
+		e = e.next
+	}
+	return true
+}
+
+// anomaly finds a small part of ops that is not linearizable on its own:
+// the shortest prefix of the history that is not, starting at the latest
+// write that still leaves it so, with every read dropped that is not needed
+// to show it. Only writes that overlap no other operation are tried, as
+// they put the register in a known state, and dropping a read never makes a
+// history less linearizable, so the anomaly is a real one. It returns the
+// operations and the one whose completion could not be explained, or nil if
+// ops is linearizable.
+func anomaly(ops []*historyOp) ([]*historyOp, *historyOp) {
+	if linearizable(ops) {
+		return nil, nil
+	}
+	var rets []time.Time
+	for _, op := range ops {
+		if !op.pending {
+			rets = append(rets, op.ret)
+		}
+	}
+	sort.Sort(byTime(rets))
+	// linearizability is closed under prefixes, so the prefixes that are
+	// not linearizable are those ending at or after some completion
+	i := sort.Search(len(rets), func(i int) bool {
+		return !linearizable(prefix(ops, rets[i]))
+	})
+	sub := prefix(ops, rets[i])
+	var last *historyOp
+	for _, op := range sub {
+		if !op.pending && op.ret.Equal(rets[i]) {
+			last = op
+		}
+	}
+	for j := len(sub) - 1; j > 0; j-- {
+		if sub[j] == last || !quiescent(sub, sub[j]) {
+			continue
+		}
+		if !linearizable(sub[j:]) {
+			sub = sub[j:]
+			break
+		}
+	}
+	for j := 0; j < len(sub); j++ {
+		if sub[j] == last || sub[j].pending || sub[j].op.F != "read" {
+			continue
+		}
+		without := append(append([]*historyOp{}, sub[:j]...), sub[j+1:]...)
+		if !linearizable(without) {
+			sub = without
+			j--
+		}
+	}
+	return sub, last
+}
+
+// quiescent reports whether w is a completed write that overlaps no other
+// operation in ops, so that the register holds its value when it completes
+// whatever happened before.
+func quiescent(ops []*historyOp, w *historyOp) bool {
+	if w.pending || w.op.F != "write" {
+		return false
+	}
+	for _, op := range ops {
+		if op != w && !op.call.After(w.ret) && (op.pending || !op.ret.Before(w.call)) {
+			return false
+		}
+	}
+	return true
+}
+
+// prefix returns the operations of ops called up to t, as they were at t:
+// those completing later are pending, or left out if they are reads.
+func prefix(ops []*historyOp, t time.Time) []*historyOp {
+	var p []*historyOp
+	for _, op := range ops {
+		switch {
+		case op.call.After(t):
+		case op.pending || !op.ret.After(t):
+			p = append(p, op)
+		case op.op.F != "read":
+			p = append(p, &historyOp{op: op.op, call: op.call, pending: true})
+		}
+	}
+	return p
+}
+
+type byCall []*historyOp
+
+func (o byCall) Len() int           { return len(o) }
+func (o byCall) Less(i, j int) bool { return o[i].call.Before(o[j].call) }
+func (o byCall) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+type byTime []time.Time
+
+func (t byTime) Len() int           { return len(t) }
+func (t byTime) Less(i, j int) bool { return t[i].Before(t[j]) }
+func (t byTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
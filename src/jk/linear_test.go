@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// none is the value of a read of the register before anything was written.
+const none = -1
+
+var testEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// regOp returns an operation on the register called at call and completed at
+// ret, in milliseconds. It is pending if ret is 0. A cas sets old to value.
+func regOp(f string, old, value, call, ret int) *historyOp {
+	op := &operation{Type: "ok", F: f}
+	if value != none {
+		op.Value = &value
+	}
+	if f == "cas" {
+		op.Old = &old
+	}
+	h := &historyOp{op: op, call: testEpoch.Add(time.Duration(call) * time.Millisecond)}
+	if ret == 0 {
+		h.pending = true
+		op.Type = "info"
+	} else {
+		h.ret = testEpoch.Add(time.Duration(ret) * time.Millisecond)
+	}
+	return h
+}
+
+func write(value, call, ret int) *historyOp { return regOp("write", 0, value, call, ret) }
+func read(value, call, ret int) *historyOp  { return regOp("read", 0, value, call, ret) }
+func cas(old, value, call, ret int) *historyOp {
+	return regOp("cas", old, value, call, ret)
+}
+
+var linearizableTests = []struct {
+	name string
+	ops  []*historyOp
+	want bool
+}{
+	{"empty", nil, true},
+	{"read of nothing", []*historyOp{read(none, 1, 2)}, true},
+	{"read of a value never written", []*historyOp{read(1, 1, 2)}, false},
+	{"read after write", []*historyOp{write(1, 1, 2), read(1, 3, 4)}, true},
+	{"read of nothing after write", []*historyOp{write(1, 1, 2), read(none, 3, 4)}, false},
+	{"stale read", []*historyOp{write(1, 1, 2), write(2, 3, 4), read(1, 5, 6)}, false},
+	{"read during write", []*historyOp{write(1, 1, 10), read(none, 2, 3), read(1, 4, 5)}, true},
+	{"read going back during write", []*historyOp{write(1, 1, 10), read(1, 2, 3), read(none, 4, 5)}, false},
+	{"concurrent writes in either order", []*historyOp{write(1, 1, 10), write(2, 2, 9), read(1, 11, 12)}, true},
+	{"pending write that happened", []*historyOp{write(1, 1, 0), read(1, 5, 6)}, true},
+	{"pending write that did not", []*historyOp{write(1, 1, 0), read(none, 5, 6)}, true},
+	{"pending write that happened late", []*historyOp{write(1, 1, 0), read(none, 5, 6), read(1, 7, 8)}, true},
+	{"pending write that went back", []*historyOp{write(1, 1, 0), read(1, 5, 6), read(none, 7, 8)}, false},
+	{"cas", []*historyOp{write(1, 1, 2), cas(1, 2, 3, 4), read(2, 5, 6)}, true},
+	{"cas of the wrong value", []*historyOp{write(1, 1, 2), cas(3, 2, 3, 4)}, false},
+	{"cas before a concurrent write", []*historyOp{write(1, 1, 2), cas(1, 2, 3, 6), write(3, 4, 5), read(3, 7, 8)}, true},
+	{"read of a cas a concurrent write overwrote", []*historyOp{write(1, 1, 2), cas(1, 2, 3, 6), write(3, 4, 5), read(2, 7, 8)}, false},
+}
+
+func TestLinearizable(t *testing.T) {
+	for _, tt := range linearizableTests {
+		if got := linearizable(tt.ops); got != tt.want {
+			t.Errorf("%s: linearizable = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnomaly(t *testing.T) {
+	w2, stale := write(2, 5, 6), read(1, 9, 10)
+	ops := []*historyOp{
+		write(1, 1, 2), read(1, 3, 4),
+		w2, read(2, 7, 8),
+		stale, read(2, 11, 12),
+	}
+	sub, last := anomaly(ops)
+	if last != stale {
+		t.Fatalf("anomaly explains %v, want the stale read", last)
+	}
+	// the reads of 1 and 2 before the stale read are not needed to show it
+	if len(sub) != 2 || sub[0] != w2 || sub[1] != stale {
+		t.Errorf("anomaly = %v, want the write of 2 and the stale read", sub)
+	}
+	if linearizable(sub) {
+		t.Errorf("the anomaly is linearizable")
+	}
+
+	if sub, last := anomaly(ops[:4]); sub != nil || last != nil {
+		t.Errorf("anomaly of a linearizable history = %v, %v", sub, last)
+	}
+}
+
+func TestHistoryOps(t *testing.T) {
+	one := 1
+	msg := func(ms int, op operation) *message {
+		return &message{Type: msgOp, Time: testEpoch.Add(time.Duration(ms) * time.Millisecond), Op: &op}
+	}
+	ops := historyOps([]*message{
+		msg(1, operation{Process: 0, Type: "invoke", F: "write", Value: &one}),
+		msg(2, operation{Process: 1, Type: "invoke", F: "read"}),
+		msg(3, operation{Process: 0, Type: "ok", F: "write", Value: &one}),
+		msg(4, operation{Process: 1, Type: "info", F: "read"}),
+		msg(5, operation{Process: 2, Type: "invoke", F: "write", Value: &one}),
+		msg(6, operation{Process: 2, Type: "fail", F: "write", Value: &one}),
+		msg(7, operation{Process: 3, Type: "invoke", F: "cas", Old: &one, Value: &one}),
+	})
+	// the failed write and the read that never completed are left out
+	if len(ops) != 2 {
+		t.Fatalf("historyOps = %d operations, want 2", len(ops))
+	}
+	if ops[0].pending || ops[0].op.F != "write" || !ops[0].ret.Equal(testEpoch.Add(3*time.Millisecond)) {
+		t.Errorf("first operation = %+v, want the completed write", ops[0])
+	}
+	if !ops[1].pending || ops[1].op.F != "cas" {
+		t.Errorf("second operation = %+v, want the pending cas", ops[1])
+	}
+}
@@ -16,7 +16,15 @@ import (
 // commands lists the available commands and help topics printed in order.
 var commands = []*Command{
 	cmdDaemon,
+	cmdRun,
+	cmdChaos,
 	cmdWatch,
+	cmdHistory,
+	cmdCheck,
+	cmdFault,
+	cmdProvision,
+	cmdTeardown,
+	cmdCleanup,
 }
 
 const defaultPort = 31415
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+)
+
+// cloneBase is the container join faults clone unless they name another
+// one, set with daemon -base.
+var cloneBase = "joker-base"
+
+func init() {
+	faultTypes["join"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("join needs a node")
+			}
+			base := spec.Base
+			if base == "" {
+				base = cloneBase
+			}
+			return &join{node: spec.Node, base: base}, nil
+		},
+	}
+	faultTypes["leave"] = &faultType{
+		args: nodeArg,
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Node == "" {
+				return nil, fmt.Errorf("leave needs a node")
+			}
+			return &leave{node: spec.Node}, nil
+		},
+	}
+}
+
+// join adds a container to the running cluster: it clones the stopped base
+// container, boots the clone and starts probing it. Healing takes it out of
+// the cluster again and destroys it.
+type join struct {
+	node, base string
+	joined     *container
+}
+
+func (j *join) Inject(containers map[string]*container) error {
+	if _, ok := containers[j.node]; ok {
+		return fmt.Errorf("container %s already exists", j.node)
+	}
+	var rt Runtime
+	for _, c := range containers {
+		rt = c.rt
+		break
+	}
+	if rt == nil {
+		return fmt.Errorf("no cluster for %s to join", j.node)
+	}
+	if err := rt.Clone(j.base, j.node, cloneOptions{}); err != nil {
+		return fmt.Errorf("could not clone %s from %s: %v", j.node, j.base, err)
+	}
+	c := &container{name: j.node, rt: rt, cmd: make(chan command, 25), cloned: true}
+	j.joined = c
+	if err := boot(c); err != nil {
+		return err
+	}
+	clusterMu.Lock()
+	containers[c.name] = c
+	clusterMu.Unlock()
+	executors.Lock()
+	if executors.output != nil {
+		startProbeExecutor(c, executors.output)
+	}
+	executors.Unlock()
+	return nil
+}
+
+func (j *join) Heal(containers map[string]*container) error {
+	if j.joined == nil {
+		return nil
+	}
+	return removeContainer(containers, j.joined)
+}
+
+func (j *join) lifecycle() {}
+
+func (j *join) String() string {
+	return fmt.Sprintf("%s from %s", j.node, j.base)
+}
+
+// leave takes a container out of the running cluster and stops it. Only
+// containers that joined are destroyed as well; the others are left for
+// the next run. A leave cannot be healed, but another node can join.
+type leave struct {
+	node string
+}
+
+func (l *leave) instant() {}
+
+func (l *leave) removes() string {
+	return l.node
+}
+
+func (l *leave) Inject(containers map[string]*container) error {
+	c, ok := containers[l.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", l.node)
+	}
+	if len(containers) == 1 {
+		return fmt.Errorf("%s is the last container", l.node)
+	}
+	return removeContainer(containers, c)
+}
+
+func (l *leave) Heal(containers map[string]*container) error {
+	return nil
+}
+
+func (l *leave) lifecycle() {}
+
+func (l *leave) String() string {
+	return l.node
+}
+
+// removeContainer takes c out of the cluster, stops its probe executor and
+// the container itself, and destroys it if a join created it.
+func removeContainer(containers map[string]*container, c *container) error {
+	clusterMu.Lock()
+	if containers[c.name] == c {
+		delete(containers, c.name)
+	}
+	clusterMu.Unlock()
+	stopProbeExecutor(c)
+
+	c.setState(stateStopping)
+	if err := c.rt.Stop(c.name); err != nil {
+		c.rt.Kill(c.name)
+	}
+	err := c.rt.Wait(c.name, "STOPPED", stateTimeout)
+	c.setState(stateStopped)
+	if err != nil {
+		return fmt.Errorf("could not stop %s: %v", c.name, err)
+	}
+	if c.cloned {
+		if err := c.rt.Destroy(c.name); err != nil {
+			return fmt.Errorf("could not destroy %s: %v", c.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the probe latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// probeCounters are the metrics of one probe over one link.
+type probeCounters struct {
+	probes, ok int64
+	buckets    []int64 // cumulative, one per latencyBuckets
+	sum        time.Duration
+}
+
+// metrics holds the counters the daemon exports in the Prometheus text
+// format. Probe results and fault events are counted by the goroutine in
+// startLog that sees them all; the gauges for faults and containers are read
+// when scraped.
+var metrics = struct {
+	sync.Mutex
+	links    map[latencyKey]*probeCounters
+	injected map[string]int64
+	clients  int
+}{
+	links:    make(map[latencyKey]*probeCounters),
+	injected: make(map[string]int64),
+}
+
+// countMessage updates the metrics for a message sent to watch.
+func countMessage(m *message) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	switch m.Type {
+	case msgProbe:
+		k := latencyKey{m.Src, m.Dest, m.Probe}
+		c := metrics.links[k]
+		if c == nil {
+			c = &probeCounters{buckets: make([]int64, len(latencyBuckets))}
+			metrics.links[k] = c
+		}
+		c.probes++
+		if !m.OK {
+			return
+		}
+		c.ok++
+		c.sum += time.Duration(m.Latency)
+		for i, b := range latencyBuckets {
+			if time.Duration(m.Latency) <= b {
+				c.buckets[i]++
+			}
+		}
+	case msgFault:
+		if m.Fault.Action == "inject" && m.Fault.Error == "" {
+			metrics.injected[m.Fault.Spec.Type]++
+		}
+	}
+}
+
+func setWatchClients(n int) {
+	metrics.Lock()
+	metrics.clients = n
+	metrics.Unlock()
+}
+
+// metricsHandler serves /metrics for a cluster.
+func metricsHandler(containers map[string]*container, faults *faultManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, membersMessage(containers).Members, faults.Info())
+	}
+}
+
+// writeMetrics writes every metric in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, members []member, active []faultInfo) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	var keys []latencyKey
+	for k := range metrics.links {
+		keys = append(keys, k)
+	}
+	sort.Sort(byLatencyKey(keys))
+	labels := func(k latencyKey) string {
+		return promLabels("src", k.src, "dest", k.dest, "probe", k.probe)
+	}
+
+	promHeader(w, "joker_probes_total", "counter", "Probes run from src to dest.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "joker_probes_total%s %d\n", labels(k), metrics.links[k].probes)
+	}
+	promHeader(w, "joker_probe_successes_total", "counter", "Probes from src to dest that succeeded.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "joker_probe_successes_total%s %d\n", labels(k), metrics.links[k].ok)
+	}
+	promHeader(w, "joker_probe_success_ratio", "gauge", "Fraction of the probes from src to dest that succeeded.")
+	for _, k := range keys {
+		c := metrics.links[k]
+		fmt.Fprintf(w, "joker_probe_success_ratio%s %s\n", labels(k), promFloat(float64(c.ok)/float64(c.probes)))
+	}
+	promHeader(w, "joker_probe_latency_seconds", "histogram", "Round trip time of successful probes from src to dest.")
+	for _, k := range keys {
+		c := metrics.links[k]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "joker_probe_latency_seconds_bucket%s %d\n",
+				promLabels("src", k.src, "dest", k.dest, "probe", k.probe, "le", promFloat(b.Seconds())), c.buckets[i])
+		}
+		fmt.Fprintf(w, "joker_probe_latency_seconds_bucket%s %d\n",
+			promLabels("src", k.src, "dest", k.dest, "probe", k.probe, "le", "+Inf"), c.ok)
+		fmt.Fprintf(w, "joker_probe_latency_seconds_sum%s %s\n", labels(k), promFloat(c.sum.Seconds()))
+		fmt.Fprintf(w, "joker_probe_latency_seconds_count%s %d\n", labels(k), c.ok)
+	}
+
+	var types []string
+	for t := range faultTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	counts := make(map[string]int)
+	for _, f := range active {
+		counts[f.Spec.Type]++
+	}
+	promHeader(w, "joker_faults_active", "gauge", "Faults currently injected, by type.")
+	for _, t := range types {
+		fmt.Fprintf(w, "joker_faults_active%s %d\n", promLabels("type", t), counts[t])
+	}
+	promHeader(w, "joker_faults_injected_total", "counter", "Faults injected, by type.")
+	for _, t := range types {
+		fmt.Fprintf(w, "joker_faults_injected_total%s %d\n", promLabels("type", t), metrics.injected[t])
+	}
+
+	promHeader(w, "joker_container_state", "gauge", "1 for the state each container is in, 0 for the others.")
+	for _, m := range members {
+		for _, state := range []string{stateRunning, stateFrozen, stateStopped, stateStarting, stateStopping} {
+			v := 0
+			if m.State == state {
+				v = 1
+			}
+			fmt.Fprintf(w, "joker_container_state%s %d\n", promLabels("name", m.Name, "state", state), v)
+		}
+	}
+
+	promHeader(w, "joker_watch_clients", "gauge", "Watch dashboards connected to the daemon.")
+	fmt.Fprintf(w, "joker_watch_clients %d\n", metrics.clients)
+}
+
+func promHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// promLabels formats name, value pairs as a label set.
+func promLabels(pairs ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+escape.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func promFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type byLatencyKey []latencyKey
+
+func (k byLatencyKey) Len() int      { return len(k) }
+func (k byLatencyKey) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byLatencyKey) Less(i, j int) bool {
+	if k[i].src != k[j].src {
+		return lessName(k[i].src, k[j].src)
+	}
+	if k[i].dest != k[j].dest {
+		return lessName(k[i].dest, k[j].dest)
+	}
+	return k[i].probe < k[j].probe
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A nemesis builds a schedule of faults out of smaller ones, like the
+// nemesis generators of Jepsen. It is one of
+//
+//	a fault, or a random fault picked by a chaos menu name (pick)
+//	a sequence of nemeses, each starting when the one before ends
+//	nemeses in parallel, all starting at once
+//	a random one of several nemeses, picked anew every time it runs
+//	another nemesis (do) run repeat times, every interval, or both
+//
+// and any of them may be limited with for. A fault lasts for its for, or
+// until the end of the run, and a nemesis with a for is cut off after it:
+// later faults are dropped and the faults still injected are healed. For
+// example "every 30s, a random majority/minority partition for 10s" is
+//
+//	{"every": "30s", "do": {"pick": "majority", "for": "10s"}}
+//
+// A nemesis is not run as such: in a scenario, or with chaos -nemesis, it is
+// expanded into timeline steps injecting each of its faults at its time,
+// with the duration it lasts, so the schedule can be printed and replayed
+// exactly. The built-in nemeses of chaos are made with the functions below.
+type nemesis struct {
+	Fault    *faultSpec `json:"fault,omitempty"`
+	Pick     string     `json:"pick,omitempty"`
+	Sequence []*nemesis `json:"sequence,omitempty"`
+	Parallel []*nemesis `json:"parallel,omitempty"`
+	Random   []*nemesis `json:"random,omitempty"`
+
+	// Do is run Repeat times one after the other, or every Every until
+	// the end, or both. With neither, it is only limited by For.
+	Do     *nemesis `json:"do,omitempty"`
+	Repeat int      `json:"repeat,omitempty"`
+	Every  duration `json:"every,omitempty"`
+
+	For duration `json:"for,omitempty"`
+}
+
+// faultNemesis injects spec.
+func faultNemesis(spec *faultSpec) *nemesis {
+	return &nemesis{Fault: spec}
+}
+
+// pickNemesis injects a random fault from the chaos menu item name.
+func pickNemesis(name string) *nemesis {
+	return &nemesis{Pick: name}
+}
+
+// sequence runs each of ns when the one before it has ended.
+func sequence(ns ...*nemesis) *nemesis {
+	return &nemesis{Sequence: ns}
+}
+
+// parallel runs all of ns at once.
+func parallel(ns ...*nemesis) *nemesis {
+	return &nemesis{Parallel: ns}
+}
+
+// randomOneOf runs one of ns picked at random.
+func randomOneOf(ns ...*nemesis) *nemesis {
+	return &nemesis{Random: ns}
+}
+
+// repeat runs do n times in a row.
+func repeat(n int, do *nemesis) *nemesis {
+	return &nemesis{Do: do, Repeat: n}
+}
+
+// every runs do every interval, or as soon as its last run ended if that
+// took longer, until the end.
+func every(interval time.Duration, do *nemesis) *nemesis {
+	return &nemesis{Do: do, Every: duration(interval)}
+}
+
+// forDuration limits n to d. A fault lasts d.
+func forDuration(d time.Duration, n *nemesis) *nemesis {
+	if n.For == 0 {
+		m := *n
+		m.For = duration(d)
+		return &m
+	}
+	return &nemesis{Do: n, For: duration(d)}
+}
+
+// validate checks n and everything in it for mistakes.
+func (n *nemesis) validate() error {
+	kinds := 0
+	for _, set := range []bool{n.Fault != nil, n.Pick != "", n.Sequence != nil, n.Parallel != nil, n.Random != nil, n.Do != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("nemesis: want exactly one of fault, pick, sequence, parallel, random and do")
+	}
+	if n.For < 0 || n.Every < 0 || n.Repeat < 0 {
+		return fmt.Errorf("nemesis: negative for, every or repeat")
+	}
+	if (n.Repeat != 0 || n.Every != 0) && n.Do == nil {
+		return fmt.Errorf("nemesis: repeat and every need a do")
+	}
+	if n.Do != nil && n.Repeat == 0 && n.Every == 0 && n.For == 0 {
+		return fmt.Errorf("nemesis: do needs a repeat, every or for")
+	}
+	switch {
+	case n.Fault != nil:
+		if n.Fault.Duration != 0 {
+			return fmt.Errorf("nemesis: give how long %s lasts as the for of the nemesis", n.Fault.Type)
+		}
+		if _, err := n.Fault.build(); err != nil {
+			return err
+		}
+	case n.Pick != "":
+		if _, ok := chaosFaults[n.Pick]; !ok {
+			return fmt.Errorf("nemesis: unknown pick %q", n.Pick)
+		}
+	case n.Do != nil:
+		return n.Do.validate()
+	}
+	children := append(append(append([]*nemesis{}, n.Sequence...), n.Parallel...), n.Random...)
+	if n.Fault == nil && n.Pick == "" && len(children) == 0 {
+		return fmt.Errorf("nemesis: empty sequence, parallel or random")
+	}
+	for _, c := range children {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// faults returns the faults n injects, apart from the ones it picks.
+func (n *nemesis) faults() []*faultSpec {
+	if n.Fault != nil {
+		return []*faultSpec{n.Fault}
+	}
+	var specs []*faultSpec
+	for _, c := range append(append(append([]*nemesis{n.Do}, n.Sequence...), n.Parallel...), n.Random...) {
+		if c != nil {
+			specs = append(specs, c.faults()...)
+		}
+	}
+	return specs
+}
+
+// bounded reports whether n ends by itself, without an end to cut it off.
+func (n *nemesis) bounded() bool {
+	switch {
+	case n.For > 0:
+		return true
+	case n.Do != nil:
+		return (n.Every == 0 || n.Repeat > 0) && n.Do.bounded()
+	}
+	for _, c := range append(append(append([]*nemesis{}, n.Sequence...), n.Parallel...), n.Random...) {
+		if !c.bounded() {
+			return false
+		}
+	}
+	return true
+}
+
+// timeline expands n, started at the offset at, into the steps injecting its
+// faults, choosing faults and containers from nodes with r. Nothing is
+// injected from end on, and faults are healed by then; an end of 0 means
+// there is none, so n must be bounded. It also returns when n ends. Like
+// chaosSchedule, it does not pick a container for kill, pause or skew while
+// an earlier fault still holds it.
+func (n *nemesis) timeline(r *rand.Rand, nodes []string, at, end time.Duration) ([]*scenarioStep, time.Duration) {
+	return n.expand(r, nodes, make(map[string]time.Duration), at, end)
+}
+
+// expand is timeline with busy holding when each container is free again.
+func (n *nemesis) expand(r *rand.Rand, nodes []string, busy map[string]time.Duration, at, end time.Duration) ([]*scenarioStep, time.Duration) {
+	if n.For > 0 && (end == 0 || at+time.Duration(n.For) < end) {
+		end = at + time.Duration(n.For)
+	}
+	if end > 0 && at >= end {
+		return nil, at
+	}
+
+	var steps []*scenarioStep
+	finish := at
+	switch {
+	case n.Fault != nil || n.Pick != "":
+		spec := n.Fault
+		if n.Pick != "" {
+			spec = chaosFaults[n.Pick](r, freeNodes(n.Pick, nodes, busy, at))
+		} else {
+			copied := *spec
+			spec = &copied
+		}
+		if spec != nil {
+			if end > 0 {
+				spec.Duration = duration(end - at)
+			}
+			if spec.Node != "" {
+				busy[spec.Node] = at + time.Duration(spec.Duration)
+			}
+			steps = append(steps, &scenarioStep{At: duration(at), Inject: spec})
+		}
+		if n.For > 0 {
+			finish = end
+		}
+
+	case n.Sequence != nil:
+		for _, c := range n.Sequence {
+			s, t := c.expand(r, nodes, busy, finish, end)
+			steps, finish = append(steps, s...), t
+		}
+
+	case n.Parallel != nil:
+		for _, c := range n.Parallel {
+			s, t := c.expand(r, nodes, busy, at, end)
+			steps = append(steps, s...)
+			if t > finish {
+				finish = t
+			}
+		}
+
+	case n.Random != nil:
+		steps, finish = n.Random[r.Intn(len(n.Random))].expand(r, nodes, busy, at, end)
+
+	case n.Do != nil:
+		start := at
+		for i := 0; n.Repeat == 0 || i < n.Repeat; i++ {
+			if end > 0 && start >= end || end == 0 && n.Repeat == 0 && i > 0 {
+				break
+			}
+			s, t := n.Do.expand(r, nodes, busy, start, end)
+			steps, finish = append(steps, s...), t
+			if n.Every == 0 && n.Repeat == 0 {
+				break // only limited by for
+			}
+			if next := start + time.Duration(n.Every); next > t {
+				t = next
+			}
+			start = t
+		}
+		if n.Every > 0 && n.Repeat == 0 {
+			finish = end
+		}
+	}
+	if end > 0 && finish > end {
+		finish = end
+	}
+	return steps, finish
+}
+
+func (n *nemesis) String() string {
+	var parts []string
+	list := func(name string, ns []*nemesis) {
+		var s []string
+		for _, c := range ns {
+			s = append(s, c.String())
+		}
+		parts = append(parts, name+"("+strings.Join(s, ", ")+")")
+	}
+	switch {
+	case n.Fault != nil:
+		parts = append(parts, n.Fault.String())
+	case n.Pick != "":
+		parts = append(parts, "random "+n.Pick)
+	case n.Sequence != nil:
+		list("sequence", n.Sequence)
+	case n.Parallel != nil:
+		list("parallel", n.Parallel)
+	case n.Random != nil:
+		list("one of", n.Random)
+	case n.Do != nil:
+		if n.Repeat > 0 {
+			parts = append(parts, fmt.Sprintf("%d times", n.Repeat))
+		}
+		if n.Every > 0 {
+			parts = append(parts, "every "+time.Duration(n.Every).String())
+		}
+		parts = append(parts, n.Do.String())
+	}
+	if n.For > 0 {
+		parts = append(parts, "for "+time.Duration(n.For).String())
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func killNode(node string) *nemesis {
+	return faultNemesis(&faultSpec{Type: "kill", Node: node})
+}
+
+var nemesisTimelineTests = []struct {
+	name    string
+	n       *nemesis
+	at, end time.Duration
+	want    []string // at, type, node and duration of every step
+	finish  time.Duration
+}{
+	{
+		name:   "fault",
+		n:      forDuration(10*time.Second, killNode("n0")),
+		at:     5 * time.Second,
+		want:   []string{"5s kill n0 10s"},
+		finish: 15 * time.Second,
+	},
+	{
+		name:   "fault lasting until the end",
+		n:      killNode("n0"),
+		at:     10 * time.Second,
+		end:    30 * time.Second,
+		want:   []string{"10s kill n0 20s"},
+		finish: 10 * time.Second,
+	},
+	{
+		name:   "sequence",
+		n:      sequence(forDuration(10*time.Second, killNode("n0")), forDuration(5*time.Second, killNode("n1"))),
+		want:   []string{"0s kill n0 10s", "10s kill n1 5s"},
+		finish: 15 * time.Second,
+	},
+	{
+		name:   "parallel",
+		n:      parallel(forDuration(10*time.Second, killNode("n0")), forDuration(5*time.Second, killNode("n1"))),
+		want:   []string{"0s kill n0 10s", "0s kill n1 5s"},
+		finish: 10 * time.Second,
+	},
+	{
+		name:   "repeat",
+		n:      repeat(3, forDuration(2*time.Second, killNode("n0"))),
+		at:     time.Second,
+		want:   []string{"1s kill n0 2s", "3s kill n0 2s", "5s kill n0 2s"},
+		finish: 7 * time.Second,
+	},
+	{
+		name:   "every",
+		n:      every(10*time.Second, forDuration(2*time.Second, killNode("n0"))),
+		end:    25 * time.Second,
+		want:   []string{"0s kill n0 2s", "10s kill n0 2s", "20s kill n0 2s"},
+		finish: 25 * time.Second,
+	},
+	{
+		name:   "every, cut off by the end",
+		n:      every(10*time.Second, forDuration(8*time.Second, killNode("n0"))),
+		end:    25 * time.Second,
+		want:   []string{"0s kill n0 8s", "10s kill n0 8s", "20s kill n0 5s"},
+		finish: 25 * time.Second,
+	},
+	{
+		name:   "every, running late",
+		n:      every(2*time.Second, forDuration(3*time.Second, killNode("n0"))),
+		end:    10 * time.Second,
+		want:   []string{"0s kill n0 3s", "3s kill n0 3s", "6s kill n0 3s", "9s kill n0 1s"},
+		finish: 10 * time.Second,
+	},
+	{
+		name:   "for cuts off every",
+		n:      forDuration(5*time.Second, every(2*time.Second, forDuration(3*time.Second, killNode("n0")))),
+		end:    time.Minute,
+		want:   []string{"0s kill n0 3s", "3s kill n0 2s"},
+		finish: 5 * time.Second,
+	},
+	{
+		name:   "nothing after the end",
+		n:      sequence(forDuration(10*time.Second, killNode("n0")), forDuration(5*time.Second, killNode("n1"))),
+		end:    8 * time.Second,
+		want:   []string{"0s kill n0 8s"},
+		finish: 8 * time.Second,
+	},
+}
+
+func TestNemesisTimeline(t *testing.T) {
+	for _, tt := range nemesisTimelineTests {
+		if err := tt.n.validate(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		r := rand.New(rand.NewSource(1))
+		steps, finish := tt.n.timeline(r, []string{"n0", "n1", "n2"}, tt.at, tt.end)
+		var got []string
+		for _, s := range steps {
+			got = append(got, fmt.Sprintf("%v %s %s %v", time.Duration(s.At), s.Inject.Type, s.Inject.Node, time.Duration(s.Inject.Duration)))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: timeline = %q, want %q", tt.name, got, tt.want)
+		}
+		if finish != tt.finish {
+			t.Errorf("%s: finishes at %v, want %v", tt.name, finish, tt.finish)
+		}
+	}
+}
+
+// The faults a nemesis picks at random come from its random source alone.
+func TestNemesisTimelineRandom(t *testing.T) {
+	n := every(10*time.Second, randomOneOf(
+		forDuration(5*time.Second, pickNemesis("majority")),
+		forDuration(5*time.Second, pickNemesis("kill"))))
+	nodes := []string{"n0", "n1", "n2", "n3", "n4"}
+	timeline := func(seed int64) string {
+		steps, _ := n.timeline(rand.New(rand.NewSource(seed)), nodes, 0, time.Minute)
+		var s string
+		for _, step := range steps {
+			s += fmt.Sprintf("+%v %v\n", time.Duration(step.At), step.Inject)
+		}
+		return s
+	}
+	if a, b := timeline(42), timeline(42); a != b {
+		t.Errorf("the same seed gave\n%s\nand\n%s", a, b)
+	}
+	if timeline(42) == timeline(43) {
+		t.Errorf("different seeds gave the same timeline")
+	}
+}
+
+var nemesisValidateTests = []struct {
+	name string
+	n    *nemesis
+	ok   bool
+}{
+	{"fault", killNode("n0"), true},
+	{"pick", pickNemesis("majority"), true},
+	{"unknown pick", pickNemesis("meteor"), false},
+	{"nothing", &nemesis{}, false},
+	{"fault and pick", &nemesis{Fault: &faultSpec{Type: "kill", Node: "n0"}, Pick: "kill"}, false},
+	{"empty sequence", sequence(), false},
+	{"do without repeat, every or for", &nemesis{Do: killNode("n0")}, false},
+	{"repeat without do", &nemesis{Repeat: 2, Fault: &faultSpec{Type: "kill", Node: "n0"}}, false},
+	{"fault with its own duration", faultNemesis(&faultSpec{Type: "kill", Node: "n0", Duration: duration(time.Second)}), false},
+	{"invalid fault", faultNemesis(&faultSpec{Type: "kill"}), false},
+	{"invalid fault in a sequence", sequence(killNode("n0"), faultNemesis(&faultSpec{Type: "flood"})), false},
+}
+
+func TestNemesisValidate(t *testing.T) {
+	for _, tt := range nemesisValidateTests {
+		if err := tt.n.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netemDev is the container side of the veth pair.
+const netemDev = "eth0"
+
+// prio qdiscs support at most 16 bands. Band 1 carries unshaped traffic, so
+// up to 15 links out of one container can be degraded at the same time.
+const netemBands = 16
+
+func init() {
+	faultTypes["netem"] = &faultType{
+		args: func(spec *faultSpec, args []string) error {
+			switch len(args) {
+			case 0:
+			case 2:
+				spec.Src, spec.Dest = args[0], args[1]
+			default:
+				return fmt.Errorf("netem: want src and dest, got %q", strings.Join(args, " "))
+			}
+			return nil
+		},
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Src == "" || spec.Dest == "" {
+				return nil, fmt.Errorf("netem needs a src and a dest")
+			}
+			if spec.Src == spec.Dest {
+				return nil, fmt.Errorf("netem src and dest are both %s", spec.Src)
+			}
+			n := &netem{src: spec.Src, dest: spec.Dest}
+			if spec.Delay > 0 {
+				n.opts = append(n.opts, "delay", netemTime(spec.Delay))
+				if spec.Jitter > 0 {
+					n.opts = append(n.opts, netemTime(spec.Jitter))
+				}
+			} else if spec.Jitter > 0 {
+				return nil, fmt.Errorf("netem jitter needs a delay")
+			}
+			if spec.Reorder > 0 && spec.Delay == 0 {
+				return nil, fmt.Errorf("netem reorder needs a delay")
+			}
+			for _, p := range []struct {
+				name  string
+				value float64
+			}{
+				{"loss", spec.Loss},
+				{"duplicate", spec.Duplicate},
+				{"reorder", spec.Reorder},
+				{"corrupt", spec.Corrupt},
+			} {
+				if p.value > 0 {
+					n.opts = append(n.opts, p.name, strconv.FormatFloat(p.value, 'f', -1, 64)+"%")
+				}
+			}
+			if len(n.opts) == 0 {
+				return nil, fmt.Errorf("netem needs at least one of delay, loss, duplicate, reorder or corrupt")
+			}
+			return n, nil
+		},
+	}
+}
+
+// netem degrades the link from src to dest with the tc netem discipline.
+// Each container that has degraded links gets a root prio qdisc whose first
+// band carries everything else; every netem fault takes one of the other
+// bands, hangs a netem qdisc off it and steers packets for dest into it with
+// a u32 filter. Only traffic leaving src is shaped, so a delay is seen once
+// per round trip whichever side starts the conversation.
+type netem struct {
+	src, dest string
+	opts      []string
+	band      int
+}
+
+func (n *netem) Inject(containers map[string]*container) error {
+	src, ok := containers[n.src]
+	if !ok {
+		return fmt.Errorf("no container named %s", n.src)
+	}
+	dest, ok := containers[n.dest]
+	if !ok {
+		return fmt.Errorf("no container named %s", n.dest)
+	}
+
+	if len(src.netemBands) == 0 {
+		// send everything to band 1 unless a filter says otherwise
+		args := []string{"qdisc", "add", "dev", netemDev, "root", "handle", "1:", "prio", "bands", strconv.Itoa(netemBands), "priomap"}
+		for i := 0; i < 16; i++ {
+			args = append(args, "0")
+		}
+		if err := tc(src, args...); err != nil {
+			return err
+		}
+		src.netemBands = make(map[int]bool)
+	}
+	for b := 2; b <= netemBands; b++ {
+		if !src.netemBands[b] {
+			n.band = b
+			break
+		}
+	}
+	if n.band == 0 {
+		return fmt.Errorf("%s already has %d degraded links", n.src, netemBands-1)
+	}
+	src.netemBands[n.band] = true
+
+	args := []string{"qdisc", "add", "dev", netemDev, "parent", n.class(), "handle", fmt.Sprintf("%x:", 0x10+n.band), "netem"}
+	if err := tc(src, append(args, n.opts...)...); err != nil {
+		return err
+	}
+	return tc(src, "filter", "add", "dev", netemDev, "parent", "1:", "protocol", "ip", "prio", strconv.Itoa(n.band),
+		"u32", "match", "ip", "dst", dest.IP()+"/32", "flowid", n.class())
+}
+
+func (n *netem) Heal(containers map[string]*container) error {
+	src, ok := containers[n.src]
+	if !ok || n.band == 0 || !src.netemBands[n.band] {
+		return nil
+	}
+	delete(src.netemBands, n.band)
+	if len(src.netemBands) == 0 {
+		// removing the root qdisc takes the filters and netem qdiscs with it
+		return tc(src, "qdisc", "del", "dev", netemDev, "root")
+	}
+	err := tc(src, "filter", "del", "dev", netemDev, "parent", "1:", "prio", strconv.Itoa(n.band))
+	if err2 := tc(src, "qdisc", "del", "dev", netemDev, "parent", n.class()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// class is the prio class of the band n uses.
+func (n *netem) class() string {
+	return fmt.Sprintf("1:%x", n.band)
+}
+
+func (n *netem) String() string {
+	return fmt.Sprintf("%s->%s %s", n.src, n.dest, strings.Join(n.opts, " "))
+}
+
+// tc runs tc inside c.
+func tc(c *container, args ...string) error {
+	if _, err := c.rt.Exec(c.name, append([]string{"tc"}, args...)...); err != nil {
+		return fmt.Errorf("tc %s on %s: %v", strings.Join(args, " "), c.name, err)
+	}
+	return nil
+}
+
+// netemTime formats d the way tc expects, e.g. 150000us.
+func netemTime(d duration) string {
+	return strconv.FormatInt(int64(time.Duration(d)/time.Microsecond), 10) + "us"
+}
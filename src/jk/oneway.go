@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func init() {
+	faultTypes["drop"] = &faultType{
+		args: func(spec *faultSpec, args []string) error {
+			switch len(args) {
+			case 0:
+			case 2:
+				spec.Src, spec.Dest = args[0], args[1]
+			default:
+				return fmt.Errorf("drop: want src and dest, got %q", strings.Join(args, " "))
+			}
+			return nil
+		},
+		build: func(spec *faultSpec) (fault, error) {
+			if spec.Src == "" || spec.Dest == "" {
+				return nil, fmt.Errorf("drop needs a src and a dest")
+			}
+			if spec.Src == spec.Dest {
+				return nil, fmt.Errorf("drop src and dest are both %s", spec.Src)
+			}
+			return &drop{src: spec.Src, dest: spec.Dest}, nil
+		},
+	}
+}
+
+// drop cuts the link from src to dest in one direction only: src can no
+// longer open connections to dest, or ping it, but dest can still reach src
+// and gets its replies. Only new connections are dropped, as dropping every
+// packet would break the replies to dest as well and cut both directions.
+// For a one-way delay, use netem, which only shapes traffic leaving src.
+type drop struct {
+	src, dest string
+	boots     map[string]int
+}
+
+func (d *drop) Inject(containers map[string]*container) error {
+	d.boots = bootCounts(containers, d.src)
+	return d.apply(containers, "-A")
+}
+
+func (d *drop) Heal(containers map[string]*container) error {
+	if c, ok := containers[d.src]; ok && rebooted(d.boots, c) {
+		return nil // the rule went with the reboot
+	}
+	return d.apply(containers, "-D")
+}
+
+func (d *drop) apply(containers map[string]*container, op string) error {
+	src, ok := containers[d.src]
+	if !ok {
+		return fmt.Errorf("no container named %s", d.src)
+	}
+	dest, ok := containers[d.dest]
+	if !ok {
+		return fmt.Errorf("no container named %s", d.dest)
+	}
+	return iptables(src, op, "OUTPUT", "DROP", "-d", dest.IP(), "-m", "conntrack", "--ctstate", "NEW")
+}
+
+func (d *drop) String() string {
+	return d.src + "-/->" + d.dest
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ruleComment tags every firewall rule joker installs so that stale rules
+// can be told apart from the container's own.
+const ruleComment = "joker"
+
+func init() {
+	faultTypes["partition"] = &faultType{
+		args: func(spec *faultSpec, args []string) error {
+			if len(args) == 0 {
+				return nil
+			}
+			groups, err := parseGroups(strings.Join(args, ""))
+			if err != nil {
+				return err
+			}
+			spec.Groups = groups
+			return nil
+		},
+		build: func(spec *faultSpec) (fault, error) {
+			if len(spec.Groups) < 2 {
+				return nil, fmt.Errorf("partition needs at least two groups")
+			}
+			seen := make(map[string]bool)
+			for _, g := range spec.Groups {
+				if len(g) == 0 {
+					return nil, fmt.Errorf("partition has an empty group")
+				}
+				for _, name := range g {
+					if seen[name] {
+						return nil, fmt.Errorf("%s is in more than one group", name)
+					}
+					seen[name] = true
+				}
+			}
+			return &partition{groups: spec.Groups}, nil
+		},
+	}
+}
+
+// partition splits the cluster into groups that cannot reach each other.
+// Containers in the same group, and containers not named in any group, keep
+// their connectivity. Each container drops incoming packets from every
+// container in a different group.
+type partition struct {
+	groups [][]string
+	boots  map[string]int
+}
+
+func (p *partition) Inject(containers map[string]*container) error {
+	var names []string
+	for _, g := range p.groups {
+		names = append(names, g...)
+	}
+	p.boots = bootCounts(containers, names...)
+	return p.apply(containers, "-A")
+}
+
+func (p *partition) Heal(containers map[string]*container) error {
+	return p.apply(containers, "-D")
+}
+
+// apply adds (-A) or deletes (-D) the partition's rules. Deleting carries on
+// past errors so that as much of the partition as possible is removed, and
+// skips the containers that lost their rules by booting again.
+func (p *partition) apply(containers map[string]*container, op string) error {
+	for _, g := range p.groups {
+		for _, name := range g {
+			if _, ok := containers[name]; !ok {
+				return fmt.Errorf("no container named %s", name)
+			}
+		}
+	}
+	var firstErr error
+	for i, g := range p.groups {
+		for j, other := range p.groups {
+			if i == j {
+				continue
+			}
+			for _, name := range g {
+				if op == "-D" && rebooted(p.boots, containers[name]) {
+					continue
+				}
+				for _, peer := range other {
+					err := iptables(containers[name], op, "INPUT", "DROP", "-s", containers[peer].IP())
+					if err != nil && op == "-A" {
+						return err
+					}
+					if err != nil && firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+func (p *partition) String() string {
+	return formatGroups(p.groups)
+}
+
+// iptables adds (-A) or deletes (-D) a rule inside c, tagged as joker's own.
+func iptables(c *container, op, chain, target string, match ...string) error {
+	args := []string{"iptables", op, chain}
+	args = append(args, match...)
+	args = append(args, "-m", "comment", "--comment", ruleComment, "-j", target)
+	if _, err := c.rt.Exec(c.name, args...); err != nil {
+		return fmt.Errorf("iptables %s %s on %s: %v", op, chain, c.name, err)
+	}
+	return nil
+}
+
+// parseGroups parses a partition written as {n0,n1}|{n2,n3,n4}. The braces
+// are optional and whitespace is ignored.
+func parseGroups(s string) ([][]string, error) {
+	s = strings.Join(strings.Fields(s), "")
+	var groups [][]string
+	for _, g := range strings.Split(s, "|") {
+		g = strings.TrimSuffix(strings.TrimPrefix(g, "{"), "}")
+		if g == "" {
+			return nil, fmt.Errorf("empty group in partition %q", s)
+		}
+		groups = append(groups, strings.Split(g, ","))
+	}
+	return groups, nil
+}
+
+func formatGroups(groups [][]string) string {
+	var parts []string
+	for _, g := range groups {
+		parts = append(parts, "{"+strings.Join(g, ",")+"}")
+	}
+	return strings.Join(parts, "|")
+}
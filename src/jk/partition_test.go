@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var parseGroupsTests = []struct {
+	in   string
+	want [][]string // nil if in is invalid
+}{
+	{"{n0,n1}|{n2,n3,n4}", [][]string{{"n0", "n1"}, {"n2", "n3", "n4"}}},
+	{"n0,n1|n2", [][]string{{"n0", "n1"}, {"n2"}}},
+	{" { n0 , n1 } | { n2 } ", [][]string{{"n0", "n1"}, {"n2"}}},
+	{"{n0}|{n1}|{n2}", [][]string{{"n0"}, {"n1"}, {"n2"}}},
+	{"{n0}", [][]string{{"n0"}}},
+	{"", nil},
+	{"{n0}|", nil},
+	{"{n0}||{n1}", nil},
+	{"{}|{n1}", nil},
+}
+
+func TestParseGroups(t *testing.T) {
+	for _, tt := range parseGroupsTests {
+		groups, err := parseGroups(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseGroups(%q) = %v, want an error", tt.in, groups)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGroups(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(groups, tt.want) {
+			t.Errorf("parseGroups(%q) = %v, want %v", tt.in, groups, tt.want)
+		}
+		if s := formatGroups(groups); !reflect.DeepEqual(mustParseGroups(t, s), groups) {
+			t.Errorf("formatGroups(%v) = %q does not parse back", groups, s)
+		}
+	}
+}
+
+func mustParseGroups(t *testing.T, s string) [][]string {
+	groups, err := parseGroups(s)
+	if err != nil {
+		t.Fatalf("parseGroups(%q): %v", s, err)
+	}
+	return groups
+}
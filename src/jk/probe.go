@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultProbeTimeout bounds a single probe unless its spec says otherwise.
+const defaultProbeTimeout = time.Second
+
+// probe checks whether one container can reach a service on another. It is
+// run from inside src, so it sees the network the way the system under test
+// does, faults included.
+type probe interface {
+	Check(src, dest *container) probeResult
+}
+
+// probeResult is the outcome of a single check.
+type probeResult struct {
+	ok      bool
+	code    string // status code, exit status or other short detail
+	latency time.Duration
+}
+
+// probeSpec is the serializable description of a probe. Which fields are
+// meaningful depends on Type.
+type probeSpec struct {
+	Type string `json:"type"`
+
+	// Name tells the results of several probes apart. It defaults to the
+	// type, followed by the port if one is given, e.g. tcp:5432.
+	Name string `json:"name,omitempty"`
+
+	// Interval is the pause between rounds of the connectivity matrix.
+	Interval duration `json:"interval,omitempty"`
+	Timeout  duration `json:"timeout,omitempty"`
+
+	// Port is the service port for tcp, udp, dns and http.
+	Port int `json:"port,omitempty"`
+
+	// http: the request to make and the status code that counts as success
+	Path   string `json:"path,omitempty"`
+	Method string `json:"method,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	// Query is the name dns resolves.
+	Query string `json:"query,omitempty"`
+
+	// Command is the shell command run by cmd. {src}, {dest} and {ip} are
+	// replaced with the names of the containers and the address of dest.
+	Command string `json:"command,omitempty"`
+}
+
+// probeTypes lists the available probes by the name used in specs. Each
+// build function validates the spec, fills in defaults and returns the probe.
+var probeTypes = map[string]func(spec *probeSpec) (probe, error){
+	"http": buildHTTPProbe,
+	"tcp":  buildTCPProbe,
+	"udp":  buildUDPProbe,
+	"icmp": buildICMPProbe,
+	"dns":  buildDNSProbe,
+	"cmd":  buildCmdProbe,
+}
+
+// parseProbeSpec parses the text form of a probe: the probe type followed by
+// key=value options, e.g.
+//
+//	tcp port=5432 interval=2s
+//	http port=8080 path=/health method=HEAD status=204
+//
+// For cmd, everything after the options is the command:
+//
+//	cmd timeout=3s redis-cli -h {ip} ping
+func parseProbeSpec(s string) (*probeSpec, error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty probe spec")
+	}
+	spec := &probeSpec{Type: words[0]}
+	if _, ok := probeTypes[spec.Type]; !ok {
+		return nil, fmt.Errorf("unknown probe type %q", spec.Type)
+	}
+	for i, w := range words[1:] {
+		j := strings.Index(w, "=")
+		if j < 0 {
+			if spec.Type != "cmd" {
+				return nil, fmt.Errorf("%s: unexpected argument %q", spec.Type, w)
+			}
+			spec.Command = strings.Join(words[1+i:], " ")
+			break
+		}
+		if err := spec.set(w[:j], w[j+1:]); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// set assigns a key=value option from a text spec.
+func (s *probeSpec) set(key, value string) error {
+	switch key {
+	case "name":
+		s.Name = value
+	case "path":
+		s.Path = value
+	case "method":
+		s.Method = value
+	case "query":
+		s.Query = value
+	case "interval", "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s probe: bad %s: %v", s.Type, key, err)
+		}
+		if key == "interval" {
+			s.Interval = duration(d)
+		} else {
+			s.Timeout = duration(d)
+		}
+	case "port", "status":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s probe: bad %s: %v", s.Type, key, err)
+		}
+		if key == "port" {
+			s.Port = n
+		} else {
+			s.Status = n
+		}
+	default:
+		return fmt.Errorf("%s probe: unknown option %q", s.Type, key)
+	}
+	return nil
+}
+
+func (s *probeSpec) String() string {
+	words := []string{s.Type}
+	for _, opt := range []struct{ key, value string }{
+		{"name", s.Name},
+		{"port", strconv.Itoa(s.Port)},
+		{"path", s.Path},
+		{"method", s.Method},
+		{"status", strconv.Itoa(s.Status)},
+		{"query", s.Query},
+		{"interval", time.Duration(s.Interval).String()},
+		{"timeout", time.Duration(s.Timeout).String()},
+	} {
+		if opt.value != "" && opt.value != "0" && opt.value != "0s" {
+			words = append(words, opt.key+"="+opt.value)
+		}
+	}
+	if s.Command != "" {
+		words = append(words, s.Command)
+	}
+	return strings.Join(words, " ")
+}
+
+// build validates s, fills in its defaults and returns the probe it describes.
+func (s *probeSpec) build() (probe, error) {
+	build, ok := probeTypes[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown probe type %q", s.Type)
+	}
+	if s.Interval == 0 {
+		s.Interval = duration(defaultProbeInterval)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = duration(defaultProbeTimeout)
+	}
+	if s.Interval < 0 || s.Timeout < 0 {
+		return nil, fmt.Errorf("%s probe: negative interval or timeout", s.Type)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return nil, fmt.Errorf("%s probe: bad port %d", s.Type, s.Port)
+	}
+	if s.Name == "" {
+		s.Name = s.Type
+		if s.Port != 0 {
+			s.Name += ":" + strconv.Itoa(s.Port)
+		}
+	}
+	return build(s)
+}
+
+// seconds is t rounded up to whole seconds, for tools that take no less.
+func seconds(t duration) string {
+	return strconv.Itoa(int(math.Ceil(time.Duration(t).Seconds())))
+}
+
+// probeFlag collects repeated -probe flags.
+type probeFlag []*probeSpec
+
+func (f *probeFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *probeFlag) Set(s string) error {
+	spec, err := parseProbeSpec(s)
+	if err != nil {
+		return err
+	}
+	if _, err := spec.build(); err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// httpProbe requests a page with curl and expects a status code.
+type httpProbe struct {
+	port         int
+	path, method string
+	status       string
+	timeout      duration
+}
+
+func buildHTTPProbe(spec *probeSpec) (probe, error) {
+	if spec.Port == 0 {
+		spec.Port = 80
+	}
+	if spec.Path == "" {
+		spec.Path = "/"
+	}
+	if !strings.HasPrefix(spec.Path, "/") {
+		return nil, fmt.Errorf("http probe: path %q does not start with /", spec.Path)
+	}
+	if spec.Method == "" {
+		spec.Method = "GET"
+	}
+	if spec.Status == 0 {
+		spec.Status = 200
+	}
+	return &httpProbe{
+		port:    spec.Port,
+		path:    spec.Path,
+		method:  strings.ToUpper(spec.Method),
+		status:  strconv.Itoa(spec.Status),
+		timeout: spec.Timeout,
+	}, nil
+}
+
+// Check uses curl's own timing, which leaves out the time it takes to attach
+// to src.
+func (p *httpProbe) Check(src, dest *container) probeResult {
+	url := fmt.Sprintf("http://%s:%d%s", dest.IP(), p.port, p.path)
+	args := []string{"curl", "-s", "-o", "/dev/null", "-w", "%{http_code} %{time_total}",
+		"-m", strconv.FormatFloat(time.Duration(p.timeout).Seconds(), 'f', -1, 64), "-X", p.method}
+	if p.method == "HEAD" {
+		// curl -X HEAD waits for a body that never comes
+		args = append(args[:len(args)-2], "-I")
+	}
+	out, err := src.rt.Exec(src.name, append(args, url)...)
+	if err != nil {
+		log.Printf("[error]: could not attach to %s\n", src.name)
+	}
+	var code string
+	var seconds float64
+	fmt.Sscanf(string(out), "%s %g", &code, &seconds)
+	return probeResult{ok: code == p.status, code: code, latency: time.Duration(seconds * float64(time.Second))}
+}
+
+// timedScript runs its arguments and prints their exit status and how long
+// they took in nanoseconds, so that probes which do not time themselves are
+// not charged for attaching to the container.
+const timedScript = `s=$(date +%s%N); "$@" >/dev/null 2>&1; r=$?; echo $r $(($(date +%s%N) - s))`
+
+// execProbe runs a command against dest and succeeds if it exits with 0.
+type execProbe struct {
+	args func(src, dest *container) []string
+}
+
+func (p *execProbe) Check(src, dest *container) probeResult {
+	args := append([]string{"sh", "-c", timedScript, "sh"}, p.args(src, dest)...)
+	out, err := src.rt.Exec(src.name, args...)
+	if err != nil {
+		log.Printf("[error]: could not attach to %s\n", src.name)
+	}
+	var code string
+	var ns int64
+	fmt.Sscanf(string(out), "%s %d", &code, &ns)
+	return probeResult{ok: code == "0", code: code, latency: time.Duration(ns)}
+}
+
+// buildTCPProbe connects to a port.
+func buildTCPProbe(spec *probeSpec) (probe, error) {
+	if spec.Port == 0 {
+		return nil, fmt.Errorf("tcp probe needs a port")
+	}
+	port, timeout := strconv.Itoa(spec.Port), seconds(spec.Timeout)
+	return &execProbe{func(src, dest *container) []string {
+		return []string{"nc", "-z", "-w", timeout, dest.IP(), port}
+	}}, nil
+}
+
+// buildUDPProbe sends a datagram to an echo service and expects it back.
+func buildUDPProbe(spec *probeSpec) (probe, error) {
+	if spec.Port == 0 {
+		spec.Port = 7
+	}
+	port, timeout := strconv.Itoa(spec.Port), seconds(spec.Timeout)
+	return &execProbe{func(src, dest *container) []string {
+		return []string{"sh", "-c", `echo joker | nc -u -w "$1" "$2" "$3" | grep -q joker`, "sh", timeout, dest.IP(), port}
+	}}, nil
+}
+
+// buildICMPProbe pings.
+func buildICMPProbe(spec *probeSpec) (probe, error) {
+	if spec.Port != 0 {
+		return nil, fmt.Errorf("icmp probe takes no port")
+	}
+	timeout := seconds(spec.Timeout)
+	return &execProbe{func(src, dest *container) []string {
+		return []string{"ping", "-c", "1", "-W", timeout, dest.IP()}
+	}}, nil
+}
+
+// buildDNSProbe asks the name server on dest to resolve a name. Any answer,
+// even NXDOMAIN, counts as success; only no answer at all fails.
+func buildDNSProbe(spec *probeSpec) (probe, error) {
+	if spec.Port == 0 {
+		spec.Port = 53
+	}
+	if spec.Query == "" {
+		spec.Query = "localhost"
+	}
+	port, timeout, query := strconv.Itoa(spec.Port), seconds(spec.Timeout), spec.Query
+	return &execProbe{func(src, dest *container) []string {
+		return []string{"dig", "+time=" + timeout, "+tries=1", "-p", port, "@" + dest.IP(), query}
+	}}, nil
+}
+
+// buildCmdProbe runs an arbitrary shell command, e.g. a client of the system
+// under test. It is killed after the timeout.
+func buildCmdProbe(spec *probeSpec) (probe, error) {
+	if spec.Command == "" {
+		return nil, fmt.Errorf("cmd probe needs a command")
+	}
+	command, timeout := spec.Command, seconds(spec.Timeout)
+	return &execProbe{func(src, dest *container) []string {
+		r := strings.NewReplacer("{src}", src.name, "{dest}", dest.name, "{ip}", dest.IP())
+		return []string{"timeout", timeout, "sh", "-c", r.Replace(command)}
+	}}, nil
+}
+
+// validateProbes builds every probe in specs and checks that their names are
+// unique.
+func validateProbes(specs []*probeSpec) error {
+	names := make(map[string]bool)
+	for i, spec := range specs {
+		if _, err := spec.build(); err != nil {
+			return fmt.Errorf("probe %d: %v", i, err)
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("probe %d: name %s used twice", i, spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func init() {
+	faultTypes["procstop"] = &faultType{
+		args: procArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			if err := checkProc(spec); err != nil {
+				return nil, err
+			}
+			if spec.Restart != "" {
+				return nil, fmt.Errorf("procstop takes no restart command")
+			}
+			return &procSignal{node: spec.Node, process: spec.Process, signal: "STOP"}, nil
+		},
+	}
+	faultTypes["prockill"] = &faultType{
+		args: procArgs,
+		build: func(spec *faultSpec) (fault, error) {
+			if err := checkProc(spec); err != nil {
+				return nil, err
+			}
+			return &procSignal{node: spec.Node, process: spec.Process, signal: "KILL", restart: spec.Restart}, nil
+		},
+	}
+}
+
+// procArgs is the args function of process faults: the container, the
+// process and, for prockill, the words of the restart command, e.g.
+//
+//	prockill n2 /run/postgresql/main.pid service postgresql start for=10s
+//
+// Positional words already given as node= or process= options are skipped.
+func procArgs(spec *faultSpec, args []string) error {
+	if spec.Node == "" && len(args) > 0 {
+		spec.Node, args = args[0], args[1:]
+	}
+	if spec.Process == "" && len(args) > 0 {
+		spec.Process, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		spec.Restart = strings.Join(args, " ")
+	}
+	return nil
+}
+
+func checkProc(spec *faultSpec) error {
+	if spec.Node == "" {
+		return fmt.Errorf("%s needs a node", spec.Type)
+	}
+	if spec.Process == "" {
+		return fmt.Errorf("%s needs a process name or pidfile", spec.Type)
+	}
+	return nil
+}
+
+// procSignal sends a signal to the processes of one program inside a
+// container, found by name with pgrep -x or read from a pidfile if process
+// is an absolute path. procstop sends SIGSTOP and SIGCONT when healed,
+// prockill sends SIGKILL and runs the restart command, if any, when healed,
+// so with for=duration it restarts the program after that long. The command
+// is run to completion, so it should start the program in the background,
+// as service and systemctl do.
+//
+// procstop records the pids it stopped in a file in /run, so that jk cleanup
+// resumes them, and only them, if the fault is never healed.
+type procSignal struct {
+	node, process string
+	signal        string
+	restart       string
+
+	pids  []string // the processes signalled
+	boots map[string]int
+}
+
+func (p *procSignal) marker() string {
+	return "/run/joker-" + p.node + "-" + strings.Trim(strings.Replace(p.process, "/", "-", -1), "-") + ".procstop"
+}
+
+// findPids returns the pids of the processes to signal in c.
+func (p *procSignal) findPids(c *container) ([]string, error) {
+	var out []byte
+	var err error
+	if strings.HasPrefix(p.process, "/") {
+		out, err = c.rt.Exec(c.name, "cat", p.process)
+	} else {
+		out, err = c.rt.Exec(c.name, "pgrep", "-x", p.process)
+	}
+	pids := strings.Fields(string(out))
+	if err != nil || len(pids) == 0 {
+		return nil, fmt.Errorf("no process %s on %s", p.process, c.name)
+	}
+	return pids, nil
+}
+
+func (p *procSignal) Inject(containers map[string]*container) error {
+	c, ok := containers[p.node]
+	if !ok {
+		return fmt.Errorf("no container named %s", p.node)
+	}
+	pids, err := p.findPids(c)
+	if err != nil {
+		return err
+	}
+	p.boots = bootCounts(containers, p.node)
+	if p.signal == "STOP" {
+		if err := execScript(c, "echo "+shellQuote(strings.Join(pids, " "))+" > "+shellQuote(p.marker())); err != nil {
+			return fmt.Errorf("could not write %s: %v", p.marker(), err)
+		}
+		// if kill fails, healing resumes those it did stop
+		p.pids = pids
+	}
+	if _, err := c.rt.Exec(c.name, append([]string{"kill", "-" + p.signal}, pids...)...); err != nil {
+		return fmt.Errorf("could not send SIG%s to %s on %s: %v", p.signal, p.process, c.name, err)
+	}
+	p.pids = pids
+	return nil
+}
+
+func (p *procSignal) Heal(containers map[string]*container) error {
+	c, ok := containers[p.node]
+	if !ok || p.pids == nil || rebooted(p.boots, c) {
+		return nil // the processes went with the reboot
+	}
+	switch {
+	case p.signal == "STOP":
+		if _, err := c.rt.Exec(c.name, append([]string{"kill", "-CONT"}, p.pids...)...); err != nil {
+			return fmt.Errorf("could not send SIGCONT to %s on %s: %v", p.process, c.name, err)
+		}
+		if err := execScript(c, "rm -f "+shellQuote(p.marker())); err != nil {
+			return fmt.Errorf("could not remove %s: %v", p.marker(), err)
+		}
+	case p.restart != "":
+		if _, err := c.rt.Exec(c.name, "sh", "-c", p.restart); err != nil {
+			return fmt.Errorf("could not restart %s on %s: %v", p.process, c.name, err)
+		}
+	}
+	return nil
+}
+
+func (p *procSignal) String() string {
+	s := fmt.Sprintf("%s:%s SIG%s", p.node, p.process, p.signal)
+	if p.pids != nil {
+		s += " pid " + strings.Join(p.pids, ",")
+	}
+	if p.restart != "" {
+		s += ", then " + p.restart
+	}
+	return s
+}
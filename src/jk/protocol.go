@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// protocolVersion is the version of the messages exchanged by daemon and
+// watch and recorded in histories. Daemon and watch only talk at the same
+// version, so bump it whenever a peer built before a change could not make
+// sense of what it is sent: a new message type, or a field whose meaning
+// changed. Version 2 added the probe name and the latency, faults, op,
+// command and result messages.
+const protocolVersion = 2
+
+// handshakeTimeout bounds how long either side waits for the other's hello.
+const handshakeTimeout = 5 * time.Second
+
+// message is the unit of the daemon/watch protocol. Messages are sent as
+// newline delimited JSON objects. A connection starts with the watch sending
+// a hello carrying its protocol version; the daemon answers with its own
+// hello, or with an error and a hangup if it cannot speak that version.
+// Which of the other fields are set depends on Type.
+type message struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// hello
+	Version int `json:"version,omitempty"`
+
+	// probe: the outcome of checking connectivity from Src to Dest with
+	// the named probe
+	Src     string   `json:"src,omitempty"`
+	Dest    string   `json:"dest,omitempty"`
+	Probe   string   `json:"probe,omitempty"`
+	OK      bool     `json:"ok,omitempty"`
+	Code    string   `json:"code,omitempty"`
+	Latency duration `json:"latency,omitempty"`
+
+	// fault: a fault was injected or healed
+	Fault *faultEvent `json:"fault,omitempty"`
+
+	// members: the containers in the cluster
+	Members []member `json:"members,omitempty"`
+
+	// latency: percentiles of the recent round trip times of every link
+	Latencies []linkLatency `json:"latencies,omitempty"`
+
+	// faults: every active fault, sent whenever the set changes
+	Faults []faultInfo `json:"faults,omitempty"`
+
+	// op: an operation of the client workload was invoked or completed
+	Op *operation `json:"op,omitempty"`
+
+	// command: a request from watch to the daemon, answered with a result
+	// that has Error set if it failed
+	Command *watchCommand `json:"command,omitempty"`
+
+	// error
+	Error string `json:"error,omitempty"`
+}
+
+// message types
+const (
+	msgHello   = "hello"
+	msgProbe   = "probe"
+	msgFault   = "fault"
+	msgMembers = "members"
+	msgLatency = "latency"
+	msgFaults  = "faults"
+	msgOp      = "op"
+	msgCommand = "command"
+	msgResult  = "result"
+	msgError   = "error"
+)
+
+func newMessage(typ string) *message {
+	return &message{Type: typ, Time: time.Now()}
+}
+
+func (m *message) String() string {
+	switch m.Type {
+	case msgProbe:
+		return fmt.Sprintf("%s -> %s %s %t %s %v", m.Src, m.Dest, m.Probe, m.OK, m.Code, time.Duration(m.Latency))
+	case msgFault:
+		return fmt.Sprintf("%s #%d %s %s", m.Fault.Action, m.Fault.ID, m.Fault.Spec.Type, m.Fault.Desc)
+	case msgMembers:
+		return fmt.Sprintf("%d members", len(m.Members))
+	case msgLatency:
+		return fmt.Sprintf("%d links", len(m.Latencies))
+	case msgFaults:
+		return fmt.Sprintf("%d active faults", len(m.Faults))
+	case msgOp:
+		return m.Op.String()
+	case msgCommand:
+		return m.Command.String()
+	case msgError:
+		return m.Error
+	}
+	return m.Type
+}
+
+// faultEvent describes a change to the set of active faults.
+type faultEvent struct {
+	ID     int        `json:"id"`
+	Action string     `json:"action"` // inject or heal
+	Spec   *faultSpec `json:"spec"`
+	Desc   string     `json:"desc,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// faultInfo describes an active fault.
+type faultInfo struct {
+	ID    int        `json:"id"`
+	Spec  *faultSpec `json:"spec"`
+	Desc  string     `json:"desc"`
+	Since time.Time  `json:"since"`
+}
+
+// watchCommand asks the daemon to change the active faults.
+type watchCommand struct {
+	Action string     `json:"action"` // inject, heal or heal-all
+	Spec   *faultSpec `json:"spec,omitempty"`
+	ID     int        `json:"id,omitempty"`
+}
+
+func (c *watchCommand) String() string {
+	switch c.Action {
+	case "inject":
+		return "inject " + c.Spec.String()
+	case "heal":
+		return fmt.Sprintf("heal #%d", c.ID)
+	}
+	return c.Action
+}
+
+// operation is an invocation or completion of a workload operation, see
+// workload.go.
+type operation struct {
+	Process int    `json:"process"`
+	Node    string `json:"node"`
+	Type    string `json:"type"` // invoke, ok, fail or info
+	F       string `json:"f"`    // read, write or cas
+
+	// Value is the value written, the new value of a cas, or the value
+	// read once the read completed. Old is the value a cas expects.
+	Value *int   `json:"value,omitempty"`
+	Old   *int   `json:"old,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (op *operation) String() string {
+	s := fmt.Sprintf("p%d %s %s %s", op.Process, op.Node, op.Type, op.F)
+	switch {
+	case op.F == "cas":
+		s += fmt.Sprintf(" %s->%s", formatValue(op.Old), formatValue(op.Value))
+	case op.F == "write" || op.Type == "ok":
+		s += " " + formatValue(op.Value)
+	}
+	if op.Error != "" {
+		s += ": " + op.Error
+	}
+	return s
+}
+
+// formatValue formats a register value; nil is an empty register.
+func formatValue(v *int) string {
+	if v == nil {
+		return "nil"
+	}
+	return strconv.Itoa(*v)
+}
+
+// member is a container in the cluster as seen by the daemon.
+type member struct {
+	Name  string `json:"name"`
+	IP    string `json:"ip"`
+	State string `json:"state"`
+
+	// Skew describes the clock skew injected into the container, if any.
+	Skew string `json:"skew,omitempty"`
+}
+
+// linkLatency summarizes the round trip times of the latest successful
+// probes of one link, see latencyWindow.
+type linkLatency struct {
+	Src     string   `json:"src"`
+	Dest    string   `json:"dest"`
+	Probe   string   `json:"probe,omitempty"`
+	Samples int      `json:"samples"`
+	P50     duration `json:"p50"`
+	P95     duration `json:"p95"`
+	P99     duration `json:"p99"`
+	Max     duration `json:"max"`
+}
+
+// acceptHandshake performs the daemon's side of the handshake on conn.
+func acceptHandshake(conn net.Conn, enc *json.Encoder, dec *json.Decoder) error {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var hello message
+	if err := dec.Decode(&hello); err != nil {
+		return fmt.Errorf("reading hello: %v", err)
+	}
+	if hello.Type != msgHello || hello.Version != protocolVersion {
+		reply := newMessage(msgError)
+		reply.Error = fmt.Sprintf("daemon speaks protocol version %d, watch sent %s version %d",
+			protocolVersion, hello.Type, hello.Version)
+		enc.Encode(reply)
+		return fmt.Errorf("%s", reply.Error)
+	}
+	reply := newMessage(msgHello)
+	reply.Version = protocolVersion
+	return enc.Encode(reply)
+}
+
+// dialHandshake performs the watch's side of the handshake on conn.
+func dialHandshake(conn net.Conn, enc *json.Encoder, dec *json.Decoder) error {
+	hello := newMessage(msgHello)
+	hello.Version = protocolVersion
+	if err := enc.Encode(hello); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var reply message
+	if err := dec.Decode(&reply); err != nil {
+		return fmt.Errorf("no hello from daemon (is it too old?): %v", err)
+	}
+	switch {
+	case reply.Type == msgError:
+		return fmt.Errorf("daemon refused connection: %s", reply.Error)
+	case reply.Type != msgHello:
+		return fmt.Errorf("daemon sent %q instead of hello (is it too old?)", reply.Type)
+	case reply.Version != protocolVersion:
+		return fmt.Errorf("daemon speaks protocol version %d, watch speaks %d", reply.Version, protocolVersion)
+	}
+	return nil
+}
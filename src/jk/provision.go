@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+var (
+	provisionRuntime  string
+	provisionPrefix   string
+	provisionCount    int
+	provisionSnapshot bool
+	provisionMAC      string
+	provisionIP       string
+	teardownRuntime   string
+	teardownPrefix    string
+	teardownCount     int
+)
+
+func init() {
+	cmdProvision.Run = runProvision
+	cmdProvision.Flag.StringVar(&provisionRuntime, "runtime", "lxc", "")
+	cmdProvision.Flag.StringVar(&cloneBase, "base", cloneBase, "")
+	cmdProvision.Flag.IntVar(&provisionCount, "count", numContainers, "")
+	cmdProvision.Flag.StringVar(&provisionPrefix, "prefix", "n", "")
+	cmdProvision.Flag.BoolVar(&provisionSnapshot, "snapshot", true, "")
+	cmdProvision.Flag.StringVar(&provisionMAC, "mac", "", "")
+	cmdProvision.Flag.StringVar(&provisionIP, "ip", "", "")
+
+	cmdTeardown.Run = runTeardown
+	cmdTeardown.Flag.StringVar(&teardownRuntime, "runtime", "lxc", "")
+	cmdTeardown.Flag.IntVar(&teardownCount, "count", numContainers, "")
+	cmdTeardown.Flag.StringVar(&teardownPrefix, "prefix", "n", "")
+}
+
+var cmdProvision = &Command{
+	UsageLine: "provision [flags]",
+	Short:     "create the containers from a base container",
+	Long: `
+provision creates the containers daemon, run and chaos use, named n0, n1, ...,
+as clones of a stopped base container that has the system under test set up,
+so every run can start from a fresh cluster and throw it away afterwards
+with teardown, e.g.
+
+	jk provision && jk run scenario.json; jk teardown
+
+provision fails for containers that exist already.
+
+provision supports the following flags:
+
+	-runtime name
+		container runtime to use: lxc (default) or fake.
+
+	-base name
+		container to clone. defaults to joker-base.
+
+	-count n
+		number of containers to create. defaults to 5.
+
+	-prefix p
+		name the containers p0, p1, ... as the count and prefix of a
+		scenario do. defaults to n.
+
+	-snapshot=false
+		make full copies of the base instead of overlay snapshots. a
+		snapshot takes no time to make and little space, but the base
+		must be left alone while it has any.
+
+	-mac addr
+		hardware address of the first container, e.g. 00:16:3e:aa:aa:00. the others get
+		the addresses after it. by default every clone gets a random one.
+
+	-ip addr/prefix
+		static address of the first container, e.g. 10.0.3.10/24. the others get the
+		addresses after it. by default the addresses are configured as
+		in the base, usually by DHCP.
+
+with lxc, -mac and -ip set lxc.net.0.hwaddr and lxc.net.0.ipv4.address in
+the config of every clone, which needs lxc 2.1 or later.
+`,
+}
+
+var cmdTeardown = &Command{
+	UsageLine: "teardown [flags] [name ...]",
+	Short:     "destroy the containers",
+	Long: `
+teardown stops and destroys the named containers, by default the ones
+provision creates. containers that do not exist are skipped.
+
+teardown supports the following flags:
+
+	-runtime name
+		container runtime to use: lxc (default) or fake.
+
+	-count n
+		number of containers to destroy. defaults to 5.
+
+	-prefix p
+		destroy p0, p1, ... instead of n0, n1, ...
+`,
+}
+
+// containerNames returns the names of a cluster of n containers, prefix0,
+// prefix1, ...
+func containerNames(prefix string, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return names
+}
+
+func runProvision(c *Command, args []string) {
+	if len(args) != 0 || provisionCount < 1 {
+		c.Usage()
+	}
+	rt, err := newRuntime(provisionRuntime)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	var mac net.HardwareAddr
+	if provisionMAC != "" {
+		if mac, err = net.ParseMAC(provisionMAC); err != nil {
+			log.Fatalf("[error]: -mac: %v\n", err)
+		}
+	}
+	var ip net.IP
+	var ipNet *net.IPNet
+	if provisionIP != "" {
+		if ip, ipNet, err = net.ParseCIDR(provisionIP); err != nil {
+			log.Fatalf("[error]: -ip: %v\n", err)
+		}
+	}
+
+	// work out every address before making anything
+	names := containerNames(provisionPrefix, provisionCount)
+	opts := make([]cloneOptions, len(names))
+	for i := range names {
+		opts[i].Snapshot = provisionSnapshot
+		if mac != nil {
+			opts[i].MAC = net.HardwareAddr(addToAddr(mac, i)).String()
+		}
+		if ip != nil {
+			next := net.IP(addToAddr(ip, i))
+			if !ipNet.Contains(next) {
+				log.Fatalf("[error]: -ip: %s is outside of %s\n", next, ipNet)
+			}
+			ones, _ := ipNet.Mask.Size()
+			opts[i].IP = fmt.Sprintf("%s/%d", next, ones)
+		}
+	}
+	for i, name := range names {
+		if err := rt.Clone(cloneBase, name, opts[i]); err != nil {
+			log.Printf("[error]: could not clone %s from %s: %v\n", name, cloneBase, err)
+			setExitStatus(1)
+			continue
+		}
+		log.Printf("[info]: created %s from %s %s\n", name, cloneBase, describeClone(opts[i]))
+	}
+}
+
+// describeClone returns what opts changes about a clone, for the log.
+func describeClone(opts cloneOptions) string {
+	s := "as a copy"
+	if opts.Snapshot {
+		s = "as a snapshot"
+	}
+	if opts.MAC != "" {
+		s += ", mac " + opts.MAC
+	}
+	if opts.IP != "" {
+		s += ", ip " + opts.IP
+	}
+	return s
+}
+
+// addToAddr returns the address n after addr, carrying into the higher
+// bytes, as used for hardware and IP addresses.
+func addToAddr(addr []byte, n int) []byte {
+	next := append([]byte{}, addr...)
+	if ip4 := net.IP(addr).To4(); len(addr) == net.IPv6len && ip4 != nil {
+		next = append([]byte{}, ip4...)
+	}
+	carry := n
+	for i := len(next) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(next[i]) + carry
+		next[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return next
+}
+
+func runTeardown(c *Command, args []string) {
+	rt, err := newRuntime(teardownRuntime)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	names := args
+	if len(names) == 0 {
+		names = containerNames(teardownPrefix, teardownCount)
+	}
+	for _, name := range names {
+		if name == cloneBase {
+			log.Printf("[error]: not destroying the base container %s\n", name)
+			setExitStatus(1)
+			continue
+		}
+		state, err := rt.State(name)
+		if err != nil {
+			log.Printf("[info]: no container named %s\n", name)
+			continue
+		}
+		if state != stateStopped {
+			rt.Kill(name)
+			if err := rt.Wait(name, stateStopped, stateTimeout); err != nil {
+				log.Printf("[error]: could not stop %s: %v\n", name, err)
+				setExitStatus(1)
+				continue
+			}
+		}
+		if err := rt.Destroy(name); err != nil {
+			log.Printf("[error]: could not destroy %s: %v\n", name, err)
+			setExitStatus(1)
+			continue
+		}
+		log.Printf("[info]: destroyed %s\n", name)
+	}
+}
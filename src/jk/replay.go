@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// replayTick is how often a playing replay advances.
+const replayTick = 50 * time.Millisecond
+
+// replayer animates a recorded history on the dashboard. at is the offset
+// from the start of the run being shown; every message up to it has been
+// applied to the dashboard.
+type replayer struct {
+	mu      sync.Mutex
+	msgs    []*message
+	start   time.Time
+	length  time.Duration
+	pos     int
+	at      time.Duration
+	speed   float64
+	playing bool
+
+	signalChan chan os.Signal
+}
+
+// loadReplay reads the nth run (counting from 1) of the history at path.
+func loadReplay(path string, n int) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &replayer{speed: 1, playing: true}
+	run := 0
+	err = readHistory(f, func(m *message) error {
+		if m.Type == msgHello {
+			run++
+			if run == n {
+				r.start = m.Time
+			}
+			return nil
+		}
+		if run == n {
+			r.msgs = append(r.msgs, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if run < n {
+		return nil, fmt.Errorf("%s has %d runs, no run %d", path, run, n)
+	}
+	if len(r.msgs) == 0 {
+		return nil, fmt.Errorf("%s: run %d is empty", path, n)
+	}
+	r.length = r.offset(len(r.msgs) - 1)
+	return r, nil
+}
+
+// offset returns when the ith message happened relative to the start.
+func (r *replayer) offset(i int) time.Duration {
+	return r.msgs[i].Time.Sub(r.start)
+}
+
+// play advances the replay in real time, scaled by its speed, until it is
+// stopped.
+func (r *replayer) play() {
+	r.mu.Lock()
+	r.seek(0)
+	r.mu.Unlock()
+	for range time.Tick(replayTick) {
+		r.mu.Lock()
+		if r.playing {
+			r.advance(r.at + time.Duration(float64(replayTick)*r.speed))
+			if r.pos == len(r.msgs) {
+				r.playing = false
+			}
+			r.draw()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// advance applies every message up to offset at. The caller must hold r.mu.
+func (r *replayer) advance(at time.Duration) {
+	for r.pos < len(r.msgs) && r.offset(r.pos) <= at {
+		applyMessage(r.msgs[r.pos])
+		r.pos++
+	}
+	r.at = at
+}
+
+// seek shows the dashboard as it was at offset at. Going backwards replays
+// the history from the start. The caller must hold r.mu.
+func (r *replayer) seek(at time.Duration) {
+	if at < 0 {
+		at = 0
+	}
+	if at > r.length {
+		at = r.length
+	}
+	if at < r.at || r.pos == 0 {
+		resetBoard()
+		r.pos = 0
+	}
+	r.advance(at)
+	r.draw()
+}
+
+// step applies n messages, or takes n back if it is negative. The caller
+// must hold r.mu.
+func (r *replayer) step(n int) {
+	r.playing = false
+	pos := max(0, min(r.pos+n, len(r.msgs)))
+	if pos == 0 {
+		r.seek(0)
+		return
+	}
+	resetBoard()
+	r.pos = 0
+	r.advance(r.offset(pos - 1))
+	// later messages at the same instant were applied too
+	r.draw()
+}
+
+// draw redraws the dashboard and the replay status line. The caller must
+// hold r.mu.
+func (r *replayer) draw() {
+	drawGrid()
+	state := "playing"
+	if !r.playing {
+		state = "paused"
+	}
+	setFooter(fmt.Sprintf("replay %v / %v  event %d/%d  x%g  %s  %s",
+		r.at.Truncate(time.Second), r.length.Truncate(time.Second), r.pos, len(r.msgs), r.speed, state,
+		r.start.Add(r.at).Format("15:04:05")))
+}
+
+// key handles the replay controls.
+func (r *replayer) key(e termbox.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.Key == termbox.KeySpace {
+		if !r.playing && r.pos == len(r.msgs) {
+			r.seek(0)
+		}
+		r.playing = !r.playing
+		r.draw()
+		return
+	}
+	switch e.Ch {
+	case 'q':
+		r.signalChan <- syscall.SIGINT
+	case '.':
+		r.step(1)
+	case ',':
+		r.step(-1)
+	case '+':
+		if r.speed < 256 {
+			r.speed *= 2
+		}
+		r.draw()
+	case '-':
+		if r.speed > 1.0/16 {
+			r.speed /= 2
+		}
+		r.draw()
+	case ']':
+		r.seek(r.at + 10*time.Second)
+	case '[':
+		r.seek(r.at - 10*time.Second)
+	case '}':
+		r.seek(r.at + time.Minute)
+	case '{':
+		r.seek(r.at - time.Minute)
+	case '0':
+		r.seek(0)
+	}
+}
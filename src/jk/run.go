@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var runDryRun bool
+
+func init() {
+	cmdRun.Run = runRun
+	cmdRun.Flag.BoolVar(&runDryRun, "n", false, "")
+	addHistoryFlag(&cmdRun.Flag)
+	addKeepFlag(&cmdRun.Flag)
+}
+
+var cmdRun = &Command{
+	UsageLine: "run [-n] scenario.json",
+	Short:     "run a scenario",
+	Long: `
+run starts the containers described by a scenario file, probes them like
+daemon does, and plays back the scenario's timeline of fault injections and
+heals. when the timeline ends, or run gets SIGINT, SIGTERM or SIGHUP, every
+fault is healed and the containers are stopped. watch can be used to observe
+the run.
+
+a scenario is a JSON object with the fields:
+
+	name        free-form description
+	runtime     lxc (default) or fake
+	containers  list of container names, or
+	count       number of containers, named prefix0, prefix1, ...
+	prefix      defaults to n
+	probes      list of probes, http by default, e.g.
+	              [{"type": "http", "path": "/health", "interval": "2s"},
+	               {"type": "tcp", "port": 5432}]
+	            with the same fields as the text specs taken by
+	            daemon -probe; cmd takes its shell command as "command"
+	timeline    list of steps, each with an offset "at" and one of
+	              "inject": fault   (optionally "name" to heal it later)
+	              "heal": name      (or "all")
+	              "end": true
+	              "nemesis": nemesis
+	workload    optional client workload to run, see 'jk help check'
+	seed        seed for the random choices of nemeses. defaults to the
+	            current time; either way it is logged
+
+faults use the same fields as the text specs taken by daemon -fault,
+e.g. {"type": "netem", "src": "n0", "dest": "n1", "delay": "100ms"}.
+
+a nemesis builds a schedule out of faults. it is a JSON object with one of
+
+	"fault": fault      inject the fault
+	"pick": name        inject a random fault from the chaos menu, e.g.
+	                    majority, a partition cutting off a minority. a
+	                    kill, pause or skew picks a container no earlier
+	                    fault of the nemesis holds, or is skipped
+	"sequence": [...]   run nemeses one after the other
+	"parallel": [...]   run nemeses at the same time
+	"random": [...]     run one of the nemeses, picked at random
+	"do": nemesis       run the nemesis "repeat": n times in a row, or
+	                    "every": interval until the end, or both
+
+and an optional "for": duration. a fault lasts for its for, or until the
+end; any other nemesis is cut off after its for, healing its faults. the
+nemesis is expanded into inject steps when the scenario is loaded, so -n
+shows exactly what will be injected. e.g. every 30s, a random minority is
+partitioned off for 10s:
+
+	{"at": "0s", "nemesis": {"every": "30s", "do": {"pick": "majority", "for": "10s"}}}
+
+run supports the following flags:
+
+	-n
+		validate the scenario and print its timeline without running it.
+`+historyFlagDoc+keepFlagDoc,
+}
+
+func runRun(c *Command, args []string) {
+	if len(args) != 1 {
+		c.Usage()
+	}
+	sc, err := loadScenario(args[0])
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	if runDryRun {
+		log.Printf("%s: %d containers %v\n", args[0], len(sc.Containers), sc.Containers)
+		if sc.Seed != 0 {
+			log.Printf("seed %d\n", sc.Seed)
+		}
+		for _, step := range sc.Timeline {
+			log.Printf("\t%v\n", step)
+		}
+		return
+	}
+
+	playScenario(sc, args[0])
+}
+
+// playScenario starts the containers of sc, probes them and executes its
+// timeline. It returns once the timeline has ended or the run was
+// interrupted, and the run has been shut down.
+func playScenario(sc *scenario, label string) {
+	rt, err := newRuntime(sc.Runtime)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+
+	l := startDisplaySocket()
+	defer l.Close()
+
+	hist := openHistory()
+	defer hist.Close()
+
+	if sc.Seed != 0 {
+		log.Printf("[scenario]: %s seed %d\n", label, sc.Seed)
+	}
+	ctx := stopContext()
+	s := startSession(ctx, l, rt, sc.Containers, sc.Probes, sc.Workload, hist)
+
+	done := make(chan bool)
+	stop := make(chan bool)
+	go func() {
+		runTimeline(sc, s.faults, time.Now(), stop)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		log.Printf("[scenario]: %s finished\n", label)
+	case <-ctx.Done():
+		close(stop)
+		<-done
+		log.Printf("[scenario]: %s interrupted\n", label)
+	}
+	s.shutdown()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runtime is the interface between the daemon and whatever actually runs the
+// containers. The lxc implementation shells out to the lxc tools; the fake
+// implementation keeps everything in process so the daemon can run without
+// lxc or root.
+type Runtime interface {
+	// State returns the current state of the named container, e.g. RUNNING
+	// or STOPPED. An error means the container does not exist.
+	State(name string) (string, error)
+
+	// Start boots the named container without waiting for it to be running.
+	Start(name string) error
+
+	// Stop shuts down the named container without waiting for it to stop.
+	Stop(name string) error
+
+	// Kill stops the named container immediately, without a clean shutdown.
+	Kill(name string) error
+
+	// Freeze suspends every process in the named container; Unfreeze
+	// resumes them.
+	Freeze(name string) error
+	Unfreeze(name string) error
+
+	// Wait blocks until the named container reaches state or timeout expires.
+	Wait(name, state string, timeout time.Duration) error
+
+	// IP returns the address of the named container, if it has one yet.
+	IP(name string) (string, error)
+
+	// Exec runs a command inside the named container and returns its stdout.
+	Exec(name string, args ...string) ([]byte, error)
+
+	// Clone creates a stopped container called name as a copy of the
+	// stopped container base, set up as opts says.
+	Clone(base, name string, opts cloneOptions) error
+
+	// Destroy deletes the named container, which must be stopped.
+	Destroy(name string) error
+}
+
+// cloneOptions are the settings of a container made by Runtime.Clone. The
+// zero value makes a full copy with the network settings of the base.
+type cloneOptions struct {
+	// Snapshot makes a copy-on-write clone, an overlay on top of the base,
+	// which is much quicker to make and to destroy. The base must not
+	// change while it has snapshot clones.
+	Snapshot bool
+
+	// MAC and IP replace the hardware address and the static address,
+	// with its prefix length, e.g. 10.0.3.10/24, of the first network
+	// interface.
+	MAC string
+	IP  string
+}
+
+// runtimes lists the available runtimes by the name used with -runtime.
+var runtimes = map[string]func() Runtime{
+	"lxc":  func() Runtime { return lxcRuntime{} },
+	"fake": func() Runtime { return newFakeRuntime() },
+}
+
+func newRuntime(name string) (Runtime, error) {
+	f, ok := runtimes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown runtime %q", name)
+	}
+	return f(), nil
+}
+
+// lxcRuntime manages containers with the lxc command line tools.
+type lxcRuntime struct{}
+
+func (lxcRuntime) State(name string) (string, error) {
+	out, err := exec.Command("sudo", "lxc-info", "-n", name, "-s").Output()
+	if err != nil {
+		return "", err
+	}
+	i := strings.Index(string(out), ":")
+	if i < 0 {
+		return "", fmt.Errorf("unexpected lxc-info output %q", out)
+	}
+	return strings.TrimSpace(string(out[i+1:])), nil
+}
+
+func (lxcRuntime) Start(name string) error {
+	return exec.Command("sudo", "lxc-start", "-n", name).Run()
+}
+
+func (lxcRuntime) Stop(name string) error {
+	return exec.Command("sudo", "lxc-stop", "-n", name).Run()
+}
+
+func (lxcRuntime) Kill(name string) error {
+	return exec.Command("sudo", "lxc-stop", "-k", "-n", name).Run()
+}
+
+func (lxcRuntime) Freeze(name string) error {
+	return exec.Command("sudo", "lxc-freeze", "-n", name).Run()
+}
+
+func (lxcRuntime) Unfreeze(name string) error {
+	return exec.Command("sudo", "lxc-unfreeze", "-n", name).Run()
+}
+
+func (lxcRuntime) Wait(name, state string, timeout time.Duration) error {
+	secs := strconv.Itoa(int(timeout / time.Second))
+	return exec.Command("sudo", "lxc-wait", "-n", name, "-s", state, "-t", secs).Run()
+}
+
+func (lxcRuntime) IP(name string) (string, error) {
+	out, err := exec.Command("sudo", "lxc-info", "-n", name, "-i").Output()
+	if err != nil {
+		return "", err
+	}
+	split := strings.Split(string(out), ":")
+	if len(split) != 2 {
+		return "", errors.New("no ip address assigned")
+	}
+	return strings.TrimSpace(split[1]), nil
+}
+
+func (lxcRuntime) Exec(name string, args ...string) ([]byte, error) {
+	a := append([]string{"lxc-attach", "--clear-env", "-n", name, "--"}, args...)
+	return exec.Command("sudo", a...).Output()
+}
+
+func (lxcRuntime) Clone(base, name string, opts cloneOptions) error {
+	args := []string{"lxc-copy", "-n", base, "-N", name}
+	if opts.Snapshot {
+		args = append(args, "-s")
+	}
+	if out, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	var keys, values []string
+	if opts.MAC != "" {
+		keys, values = append(keys, "lxc.net.0.hwaddr"), append(values, opts.MAC)
+	}
+	if opts.IP != "" {
+		keys, values = append(keys, "lxc.net.0.ipv4.address"), append(values, opts.IP)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	out, err := exec.Command("sudo", "lxc-config", "lxc.lxcpath").Output()
+	if err != nil {
+		return fmt.Errorf("could not find the lxc path: %v", err)
+	}
+	config := shellQuote(strings.TrimSpace(string(out)) + "/" + name + "/config")
+	script := "set -e\n"
+	for i, key := range keys {
+		script += fmt.Sprintf("sed -i '/^%s *=/d' %s\necho %s >> %s\n",
+			strings.Replace(key, ".", "\\.", -1), config, shellQuote(key+" = "+values[i]), config)
+	}
+	if err := exec.Command("sudo", "sh", "-c", script).Run(); err != nil {
+		return fmt.Errorf("could not configure the network of %s: %v", name, err)
+	}
+	return nil
+}
+
+func (lxcRuntime) Destroy(name string) error {
+	return exec.Command("sudo", "lxc-destroy", "-n", name).Run()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeLatency is the round trip time of an undegraded fake link.
+const fakeLatency = 500 * time.Microsecond
+
+// fakeRuntime is an in-process Runtime. Every container name exists and
+// starts instantly, gets the next free address in 10.0.3.0/24, and answers
+// every probe with success whenever the destination is running and no
+// iptables DROP rule is in the way. netem delay and loss on the path are
+// simulated too, and every process looked up by a process fault is found.
+// It lets the daemon run on machines without lxc.
+type fakeRuntime struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	nextHost   int
+}
+
+type fakeContainer struct {
+	state string
+	ip    string
+	rules []fakeRule
+
+	// netem qdiscs by band and the filters steering traffic into them by
+	// filter priority
+	netem   map[string]fakeNetem
+	filters map[string]fakeFilter
+}
+
+// fakeNetem is the part of a netem qdisc the fake runtime understands.
+type fakeNetem struct {
+	delay time.Duration
+	loss  float64
+}
+
+type fakeFilter struct {
+	dest string
+	band string
+}
+
+// fakeRule is the part of an iptables DROP rule the fake runtime understands.
+// A rule matching only --ctstate NEW lets replies through.
+type fakeRule struct {
+	chain   string
+	src     string
+	dest    string
+	newOnly bool
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		containers: make(map[string]*fakeContainer),
+		nextHost:   100,
+	}
+}
+
+// get returns the named container, creating it in the STOPPED state on first
+// use. The caller must hold f.mu.
+func (f *fakeRuntime) get(name string) *fakeContainer {
+	c, ok := f.containers[name]
+	if !ok {
+		c = &fakeContainer{state: "STOPPED"}
+		f.containers[name] = c
+	}
+	return c
+}
+
+func (f *fakeRuntime) State(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(name).state, nil
+}
+
+func (f *fakeRuntime) Start(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.get(name)
+	c.state = "RUNNING"
+	if c.ip == "" {
+		c.ip = fmt.Sprintf("10.0.3.%d", f.nextHost)
+		f.nextHost++
+	}
+	return nil
+}
+
+func (f *fakeRuntime) Stop(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// like a real reboot, stopping forgets firewall and qdisc state
+	c := f.get(name)
+	c.state = "STOPPED"
+	c.rules, c.netem, c.filters = nil, nil, nil
+	return nil
+}
+
+func (f *fakeRuntime) Clone(base, name string, opts cloneOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.containers[name]; ok {
+		return fmt.Errorf("%s already exists", name)
+	}
+	c := f.get(name)
+	if opts.IP != "" {
+		c.ip = strings.SplitN(opts.IP, "/", 2)[0]
+	}
+	return nil
+}
+
+func (f *fakeRuntime) Destroy(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.get(name).state != "STOPPED" {
+		return fmt.Errorf("%s is not stopped", name)
+	}
+	delete(f.containers, name)
+	return nil
+}
+
+func (f *fakeRuntime) Kill(name string) error {
+	return f.Stop(name)
+}
+
+func (f *fakeRuntime) Freeze(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.get(name)
+	if c.state != "RUNNING" {
+		return fmt.Errorf("%s is not running", name)
+	}
+	c.state = "FROZEN"
+	return nil
+}
+
+func (f *fakeRuntime) Unfreeze(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.get(name)
+	if c.state != "FROZEN" {
+		return fmt.Errorf("%s is not frozen", name)
+	}
+	c.state = "RUNNING"
+	return nil
+}
+
+func (f *fakeRuntime) Wait(name, state string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		s, _ := f.State(name)
+		if s == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not reach %s", name, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *fakeRuntime) IP(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.get(name)
+	if c.state != "RUNNING" || c.ip == "" {
+		return "", errors.New("no ip address assigned")
+	}
+	return c.ip, nil
+}
+
+func (f *fakeRuntime) Exec(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.get(name).state != "RUNNING" {
+		return nil, fmt.Errorf("%s is not running", name)
+	}
+	switch {
+	case len(args) > 1 && args[0] == "curl":
+		latency, ok := f.reach(f.get(name), args)
+		if !ok {
+			return []byte(fmt.Sprintf("000 %f", latency.Seconds())), nil
+		}
+		return []byte(fmt.Sprintf("200 %f", latency.Seconds())), nil
+	case len(args) > 3 && args[0] == "sh" && args[2] == timedScript:
+		// a probe other than http: succeed if the address it names is
+		// reachable, or if it names none
+		latency, ok := f.reach(f.get(name), args[4:])
+		status := 0
+		if !ok {
+			status = 1
+		}
+		return []byte(fmt.Sprintf("%d %d", status, latency.Nanoseconds())), nil
+	case len(args) > 2 && args[0] == "iptables":
+		return nil, f.iptables(f.get(name), args[1:])
+	case len(args) > 2 && args[0] == "tc":
+		return nil, f.get(name).tc(args[1:])
+	case len(args) > 1 && (args[0] == "pgrep" || args[0] == "cat"):
+		// every process looked up by a process fault exists
+		return []byte("100\n"), nil
+	}
+	return nil, nil
+}
+
+// reach simulates a probe from src against the first container address in
+// args and returns its round trip time and whether it succeeded. The caller
+// must hold f.mu.
+func (f *fakeRuntime) reach(src *fakeContainer, args []string) (time.Duration, bool) {
+	notAddr := func(r rune) bool { return r != '.' && (r < '0' || r > '9') }
+	var ip string
+	for _, arg := range args {
+		for _, w := range strings.FieldsFunc(arg, notAddr) {
+			for _, c := range f.containers {
+				if c.ip == w && ip == "" {
+					ip = w
+				}
+			}
+		}
+	}
+	if ip == "" {
+		return fakeLatency, true
+	}
+	dest := f.byIP(ip)
+	if dest == nil || f.blocked(src, dest) {
+		return 0, false
+	}
+	there, lostThere := src.shape(dest.ip)
+	back, lostBack := dest.shape(src.ip)
+	if lostThere || lostBack {
+		return time.Second, false
+	}
+	return fakeLatency + there + back, true
+}
+
+// tc applies the tc commands used by netem faults to c.
+func (c *fakeContainer) tc(args []string) error {
+	opt := func(name string) string {
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == name {
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+	if c.netem == nil {
+		c.netem = make(map[string]fakeNetem)
+		c.filters = make(map[string]fakeFilter)
+	}
+	switch args[0] + " " + args[1] {
+	case "qdisc add":
+		parent := opt("parent")
+		if parent == "" {
+			return nil // the root prio qdisc
+		}
+		var n fakeNetem
+		if d, err := time.ParseDuration(opt("delay")); err == nil {
+			n.delay = d
+		}
+		if p, err := strconv.ParseFloat(strings.TrimSuffix(opt("loss"), "%"), 64); err == nil {
+			n.loss = p
+		}
+		c.netem[parent] = n
+	case "qdisc del":
+		if parent := opt("parent"); parent != "" {
+			delete(c.netem, parent)
+			return nil
+		}
+		c.netem, c.filters = nil, nil
+	case "filter add":
+		c.filters[opt("prio")] = fakeFilter{
+			dest: strings.TrimSuffix(opt("dst"), "/32"),
+			band: opt("flowid"),
+		}
+	case "filter del":
+		delete(c.filters, opt("prio"))
+	default:
+		return fmt.Errorf("tc: unsupported command %q", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// shape returns the delay c's netem qdiscs add to a packet for dest, and
+// whether they drop it.
+func (c *fakeContainer) shape(dest string) (time.Duration, bool) {
+	for _, filter := range c.filters {
+		if filter.dest == dest {
+			n := c.netem[filter.band]
+			return n.delay, rand.Float64()*100 < n.loss
+		}
+	}
+	return 0, false
+}
+
+// iptables applies an iptables -A or -D command to c's rules.
+func (f *fakeRuntime) iptables(c *fakeContainer, args []string) error {
+	r := fakeRule{chain: args[1]}
+	for i := 2; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-s":
+			r.src = args[i+1]
+		case "-d":
+			r.dest = args[i+1]
+		case "--ctstate":
+			r.newOnly = args[i+1] == "NEW"
+		}
+	}
+	switch args[0] {
+	case "-A":
+		c.rules = append(c.rules, r)
+		return nil
+	case "-D":
+		for i, rule := range c.rules {
+			if rule == r {
+				c.rules = append(c.rules[:i], c.rules[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("iptables: bad rule (does a matching rule exist in that chain?)")
+	}
+	return fmt.Errorf("iptables: unsupported operation %s", args[0])
+}
+
+// blocked reports whether a firewall rule drops either the request from src
+// to dest or the reply. The caller must hold f.mu.
+func (f *fakeRuntime) blocked(src, dest *fakeContainer) bool {
+	// drops reports whether a packet from "from" to "to" is dropped
+	drops := func(from, to *fakeContainer, reply bool) bool {
+		for _, r := range from.rules {
+			if r.chain == "OUTPUT" && r.dest == to.ip && !(reply && r.newOnly) {
+				return true
+			}
+		}
+		for _, r := range to.rules {
+			if r.chain == "INPUT" && r.src == from.ip && !(reply && r.newOnly) {
+				return true
+			}
+		}
+		return false
+	}
+	return drops(src, dest, false) || drops(dest, src, true)
+}
+
+// byIP returns the running container with the given address, or nil. The
+// caller must hold f.mu.
+func (f *fakeRuntime) byIP(ip string) *fakeContainer {
+	for _, c := range f.containers {
+		if c.ip == ip && c.state == "RUNNING" {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeProbe simulates a probe from src to dest.
+func fakeProbe(rt *fakeRuntime, src, dest *container) (time.Duration, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.reach(rt.get(src.name), []string{dest.IP()})
+}
+
+type fakeLink struct {
+	src, dest string
+	ok        bool
+	latency   time.Duration // checked if ok
+}
+
+var fakeRuntimeTests = []struct {
+	name   string
+	faults []string
+	links  []fakeLink
+}{
+	{
+		name: "no faults",
+		links: []fakeLink{
+			{"n0", "n1", true, fakeLatency},
+			{"n1", "n0", true, fakeLatency},
+			{"n0", "n0", true, fakeLatency},
+		},
+	},
+	{
+		name:   "partition",
+		faults: []string{"partition {n0}|{n1,n2}"},
+		links: []fakeLink{
+			{"n0", "n1", false, 0},
+			{"n1", "n0", false, 0},
+			{"n2", "n0", false, 0},
+			{"n1", "n2", true, fakeLatency},
+		},
+	},
+	{
+		name:   "one-way drop lets replies through",
+		faults: []string{"drop n0 n1"},
+		links: []fakeLink{
+			{"n0", "n1", false, 0},
+			{"n1", "n0", true, fakeLatency},
+			{"n0", "n2", true, fakeLatency},
+		},
+	},
+	{
+		name:   "netem delays both round trips of a link",
+		faults: []string{"netem n0 n1 delay=100ms"},
+		links: []fakeLink{
+			{"n0", "n1", true, fakeLatency + 100*time.Millisecond},
+			{"n1", "n0", true, fakeLatency + 100*time.Millisecond},
+			{"n0", "n2", true, fakeLatency},
+			{"n2", "n1", true, fakeLatency},
+		},
+	},
+	{
+		name:   "netem faults on different links of a container",
+		faults: []string{"netem n0 n1 delay=100ms", "netem n0 n2 delay=200ms", "netem n2 n0 delay=50ms"},
+		links: []fakeLink{
+			{"n0", "n1", true, fakeLatency + 100*time.Millisecond},
+			{"n0", "n2", true, fakeLatency + 250*time.Millisecond},
+			{"n1", "n2", true, fakeLatency},
+		},
+	},
+	{
+		name:   "netem loss",
+		faults: []string{"netem n0 n1 loss=100%"},
+		links: []fakeLink{
+			{"n0", "n1", false, 0},
+			{"n1", "n0", false, 0},
+			{"n1", "n2", true, fakeLatency},
+		},
+	},
+	{
+		name:   "kill",
+		faults: []string{"kill n1"},
+		links: []fakeLink{
+			{"n0", "n1", false, 0},
+			{"n0", "n2", true, fakeLatency},
+		},
+	},
+}
+
+func TestFakeRuntime(t *testing.T) {
+	for _, tt := range fakeRuntimeTests {
+		rt, containers := newFakeCluster(t, 3)
+		var injected []fault
+		for _, s := range tt.faults {
+			spec, err := parseFaultSpec(s)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			f, err := spec.build()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if err := f.Inject(containers); err != nil {
+				t.Fatalf("%s: injecting %s: %v", tt.name, s, err)
+			}
+			injected = append(injected, f)
+		}
+		for _, l := range tt.links {
+			latency, ok := fakeProbe(rt, containers[l.src], containers[l.dest])
+			if ok != l.ok {
+				t.Errorf("%s: %s -> %s ok = %t, want %t", tt.name, l.src, l.dest, ok, l.ok)
+			} else if ok && latency != l.latency {
+				t.Errorf("%s: %s -> %s latency = %v, want %v", tt.name, l.src, l.dest, latency, l.latency)
+			}
+		}
+
+		// healing must leave nothing behind
+		for i := len(injected) - 1; i >= 0; i-- {
+			if err := injected[i].Heal(containers); err != nil {
+				t.Fatalf("%s: healing %s: %v", tt.name, injected[i], err)
+			}
+		}
+		for _, src := range containers {
+			for _, dest := range containers {
+				if latency, ok := fakeProbe(rt, src, dest); !ok || latency != fakeLatency {
+					t.Errorf("%s: after healing, %s -> %s = %v, %t", tt.name, src.name, dest.name, latency, ok)
+				}
+			}
+		}
+	}
+}
+
+func TestFakeRuntimeExecNeedsRunning(t *testing.T) {
+	rt, _ := newFakeCluster(t, 1)
+	if err := rt.Freeze("n0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Exec("n0", "tc", "qdisc", "del", "dev", "eth0", "root"); err == nil {
+		t.Errorf("exec in a frozen container succeeded")
+	}
+	if err := rt.Unfreeze("n0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Exec("n0", "iptables", "-D", "INPUT", "-s", "10.0.3.1", "-j", "DROP"); err == nil {
+		t.Errorf("deleting a missing iptables rule succeeded")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// scenario describes a whole experiment: the containers to run, how to probe
+// them, and a timeline of faults to inject and heal. Scenarios are written
+// as JSON, e.g.
+//
+//	{
+//		"name": "minority partition",
+//		"containers": ["n0", "n1", "n2", "n3", "n4"],
+//		"probes": [{"type": "http", "interval": "2s"}, {"type": "tcp", "port": 22}],
+//		"timeline": [
+//			{"at": "10s", "name": "p", "inject": {"type": "partition", "groups": [["n0", "n1"], ["n2", "n3", "n4"]]}},
+//			{"at": "40s", "heal": "p"},
+//			{"at": "60s", "end": true}
+//		]
+//	}
+type scenario struct {
+	Name string `json:"name,omitempty"`
+
+	// Runtime is the container runtime to use, lxc if empty.
+	Runtime string `json:"runtime,omitempty"`
+
+	// Containers are the names of the containers to start. If it is empty,
+	// Count containers named Prefix0, Prefix1, ... are started instead.
+	Containers []string `json:"containers,omitempty"`
+	Count      int      `json:"count,omitempty"`
+	Prefix     string   `json:"prefix,omitempty"`
+
+	Probes   []*probeSpec    `json:"probes,omitempty"`
+	Timeline []*scenarioStep `json:"timeline"`
+
+	// Workload, if set, is a client workload to run during the timeline.
+	Workload *workloadSpec `json:"workload,omitempty"`
+
+	// Seed seeds the random choices of nemesis steps. If it is 0, a seed
+	// is picked when the scenario is loaded.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// scenarioStep is one entry in a scenario's timeline. Exactly one of Inject,
+// Heal, End and Nemesis is set.
+type scenarioStep struct {
+	// At is the offset from the start of the run.
+	At duration `json:"at"`
+
+	// Inject is a fault to inject. Name, if set, lets a later step heal it.
+	Inject *faultSpec `json:"inject,omitempty"`
+	Name   string     `json:"name,omitempty"`
+
+	// Heal is the name of an earlier injected fault, or "all".
+	Heal string `json:"heal,omitempty"`
+
+	// End finishes the run: every fault is healed and the containers stop.
+	End bool `json:"end,omitempty"`
+
+	// Nemesis is a schedule of faults starting at At. It is replaced by
+	// steps injecting its faults when the scenario is validated.
+	Nemesis *nemesis `json:"nemesis,omitempty"`
+}
+
+func (s *scenarioStep) String() string {
+	switch {
+	case s.Inject != nil && s.Name != "":
+		return fmt.Sprintf("+%v inject %v as %s", time.Duration(s.At), s.Inject, s.Name)
+	case s.Inject != nil:
+		return fmt.Sprintf("+%v inject %v", time.Duration(s.At), s.Inject)
+	case s.Heal != "":
+		return fmt.Sprintf("+%v heal %s", time.Duration(s.At), s.Heal)
+	case s.Nemesis != nil:
+		return fmt.Sprintf("+%v nemesis %v", time.Duration(s.At), s.Nemesis)
+	}
+	return fmt.Sprintf("+%v end", time.Duration(s.At))
+}
+
+func loadScenario(path string) (*scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := &scenario{}
+	if err := json.NewDecoder(f).Decode(sc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := sc.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sc, nil
+}
+
+// validate checks sc for mistakes and fills in defaults. Nemesis steps are
+// expanded and the timeline is sorted by offset; steps with the same offset
+// keep their order.
+func (sc *scenario) validate() error {
+	if sc.Runtime == "" {
+		sc.Runtime = "lxc"
+	}
+	if _, ok := runtimes[sc.Runtime]; !ok {
+		return fmt.Errorf("unknown runtime %q", sc.Runtime)
+	}
+
+	if len(sc.Containers) == 0 {
+		if sc.Count <= 0 {
+			return fmt.Errorf("no containers")
+		}
+		if sc.Prefix == "" {
+			sc.Prefix = "n"
+		}
+		sc.Containers = containerNames(sc.Prefix, sc.Count)
+	}
+	known := make(map[string]bool)
+	for _, name := range sc.Containers {
+		if name == "" {
+			return fmt.Errorf("empty container name")
+		}
+		if known[name] {
+			return fmt.Errorf("container %s listed twice", name)
+		}
+		known[name] = true
+	}
+
+	if len(sc.Probes) == 0 {
+		sc.Probes = []*probeSpec{{Type: "http"}}
+	}
+	if err := validateProbes(sc.Probes); err != nil {
+		return err
+	}
+	if sc.Workload != nil {
+		if err := sc.Workload.validate(); err != nil {
+			return fmt.Errorf("workload: %v", err)
+		}
+	}
+
+	sort.Stable(byOffset(sc.Timeline))
+	for i, step := range sc.Timeline {
+		n := 0
+		for _, set := range []bool{step.Inject != nil, step.Heal != "", step.End, step.Nemesis != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("timeline step %d: want exactly one of inject, heal, end and nemesis", i)
+		}
+	}
+	if err := sc.expandNemeses(known); err != nil {
+		return err
+	}
+
+	injected := make(map[string]bool)
+	for i, step := range sc.Timeline {
+		switch {
+		case step.Inject != nil:
+			if _, err := step.Inject.build(); err != nil {
+				return fmt.Errorf("timeline step %d: %v", i, err)
+			}
+			if err := step.Inject.checkNodes(func(name string) bool { return known[name] }); err != nil {
+				return fmt.Errorf("timeline step %d: %v", i, err)
+			}
+			// later steps may use a container that joined, but not one
+			// that left
+			switch step.Inject.Type {
+			case "join":
+				known[step.Inject.Node] = true
+			case "leave":
+				delete(known, step.Inject.Node)
+			}
+			if step.Name != "" {
+				if injected[step.Name] {
+					return fmt.Errorf("timeline step %d: fault name %s used twice", i, step.Name)
+				}
+				injected[step.Name] = true
+			}
+		case step.Heal != "":
+			if step.Heal != "all" && !injected[step.Heal] {
+				return fmt.Errorf("timeline step %d: heal of unknown fault %s", i, step.Heal)
+			}
+		}
+	}
+	return nil
+}
+
+// expandNemeses replaces the nemesis steps of the sorted timeline with the
+// steps injecting their faults, as chosen by a random source seeded with
+// sc.Seed. Nothing is injected after the first end step. known are the
+// containers at the start.
+func (sc *scenario) expandNemeses(known map[string]bool) error {
+	var end time.Duration
+	for _, step := range sc.Timeline {
+		if step.End {
+			end = time.Duration(step.At)
+			break
+		}
+	}
+	var r *rand.Rand
+	var timeline []*scenarioStep
+	for i, step := range sc.Timeline {
+		n := step.Nemesis
+		if n == nil {
+			timeline = append(timeline, step)
+			continue
+		}
+		if step.Name != "" {
+			return fmt.Errorf("timeline step %d: a nemesis cannot be named", i)
+		}
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("timeline step %d: %v", i, err)
+		}
+		for _, spec := range n.faults() {
+			if err := spec.checkNodes(func(name string) bool { return known[name] }); err != nil {
+				return fmt.Errorf("timeline step %d: %v", i, err)
+			}
+		}
+		if end == 0 && !n.bounded() {
+			return fmt.Errorf("timeline step %d: nemesis %v never ends: give it a for or end the timeline", i, n)
+		}
+		if r == nil {
+			if sc.Seed == 0 {
+				sc.Seed = time.Now().UnixNano()
+			}
+			r = rand.New(rand.NewSource(sc.Seed))
+		}
+		steps, _ := n.timeline(r, sc.Containers, time.Duration(step.At), end)
+		timeline = append(timeline, steps...)
+	}
+	sc.Timeline = timeline
+	sort.Stable(byOffset(sc.Timeline))
+	return nil
+}
+
+type byOffset []*scenarioStep
+
+func (s byOffset) Len() int           { return len(s) }
+func (s byOffset) Less(i, j int) bool { return s[i].At < s[j].At }
+func (s byOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// runTimeline executes the steps of sc against faults, relative to start.
+// It returns when an end step is reached, the timeline runs out or stop is
+// closed, with the ids of every fault it injected.
+func runTimeline(sc *scenario, faults *faultManager, start time.Time, stop <-chan bool) []int {
+	ids := make(map[string]int)
+	var injected []int
+	for _, step := range sc.Timeline {
+		select {
+		case <-time.After(start.Add(time.Duration(step.At)).Sub(time.Now())):
+		case <-stop:
+			return injected
+		}
+		log.Printf("[scenario]: %v\n", step)
+		switch {
+		case step.Inject != nil:
+			info, err := faults.Inject(step.Inject)
+			if err != nil {
+				log.Printf("[error]: could not inject %s: %v\n", step.Inject.Type, err)
+				continue
+			}
+			injected = append(injected, info.ID)
+			if step.Name != "" {
+				ids[step.Name] = info.ID
+			}
+		case step.Heal == "all":
+			faults.HealAll()
+		case step.Heal != "":
+			id, ok := ids[step.Heal]
+			if !ok {
+				log.Printf("[error]: %s was never injected\n", step.Heal)
+				continue
+			}
+			if err := faults.Heal(id); err != nil {
+				log.Printf("[error]: %v\n", err)
+			}
+		case step.End:
+			return injected
+		}
+	}
+	return injected
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// stopSignals ask daemon, run and chaos to shut down cleanly.
+var stopSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// keepContainers is the -keep flag shared by daemon, run and chaos.
+var keepContainers bool
+
+func addKeepFlag(f *flag.FlagSet) {
+	f.BoolVar(&keepContainers, "keep", false, "")
+}
+
+// keepFlagDoc documents -keep in the Long text of those commands.
+const keepFlagDoc = `
+	-keep
+		leave the containers running at the end, e.g. to look around in
+		them. the faults are healed all the same.
+`
+
+// stopContext returns a context that is done once the process receives one
+// of stopSignals. After that the signals are no longer caught, so sending
+// another one kills the process at once.
+func stopContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// session is what daemon, run and chaos start around a cluster, kept to shut
+// it down again in order.
+type session struct {
+	containers map[string]*container
+	faults     *faultManager
+	logChan    chan *message
+	logDone    <-chan bool
+
+	// stopProbes stops the connectivity matrix generators, which are
+	// counted by probes.
+	stopProbes context.CancelFunc
+	probes     *sync.WaitGroup
+
+	work *workload
+}
+
+// startSession starts the containers called names, the probe executors, a
+// connectivity matrix generator for every probe in specs until ctx is done,
+// and the workload if there is one. Every message is recorded in hist and
+// sent to the watches connecting to l.
+func startSession(ctx context.Context, l net.Listener, rt Runtime, names []string, specs []*probeSpec, work *workloadSpec, hist *historyLog) *session {
+	containers := launchContainers(rt, names)
+	logChan := make(chan *message, 200)
+	faults := newFaultManager(containers, logChan)
+	s := &session{containers: containers, faults: faults, logChan: logChan}
+	s.logDone = startLog(l, logChan, containers, faults, hist)
+	startProbeExecutors(containers, logChan)
+	ctx, s.stopProbes = context.WithCancel(ctx)
+	s.probes = startProbes(ctx, containers, specs)
+	if work != nil {
+		s.work = startWorkload(work, containers, logChan)
+	}
+	return s
+}
+
+// shutdown stops probing and the workload, waits for the probes in flight,
+// heals every active fault and stops the containers unless -keep was given.
+// The messages sent on the way are delivered before it returns.
+func (s *session) shutdown() {
+	log.Printf("[info]: shutting down\n")
+	s.stopProbes()
+	s.probes.Wait()
+	if s.work != nil {
+		s.work.Stop()
+	}
+	stopProbeExecutors(s.containers)
+	s.faults.Close()
+	for _, c := range clusterList(s.containers) {
+		close(c.cmd)
+		if keepContainers {
+			log.Printf("[info]: leaving %s running\n", c.name)
+			continue
+		}
+		c.Stop()
+	}
+	s.logChan <- membersMessage(s.containers)
+	s.logChan <- nil
+	<-s.logDone
+}
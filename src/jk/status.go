@@ -1,8 +1,11 @@
 package main
 
+import "time"
+
 type status struct {
 	src string
 	dest string
-	summary string
+	probe string
 	outcome bool
+	latency time.Duration
 }
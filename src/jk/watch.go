@@ -1,21 +1,32 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/nsf/termbox-go"
 )
 
+var slowThreshold time.Duration
+var replayPath string
+var replayRun int
+var watchProbe string
+
 func init() {
 	cmdWatch.Run = runWatch
+	cmdWatch.Flag.DurationVar(&slowThreshold, "slow", 200*time.Millisecond, "")
+	cmdWatch.Flag.StringVar(&replayPath, "replay", "", "")
+	cmdWatch.Flag.IntVar(&replayRun, "run", 1, "")
+	cmdWatch.Flag.StringVar(&watchProbe, "probe", "", "")
 }
 
 var cmdWatch = &Command {
@@ -24,10 +35,50 @@ var cmdWatch = &Command {
 	Long: `
 watch displays a dashboard to monitor network connectivity between containers
 
-data for watch comes from daemon
+data for watch comes from daemon. the matrix has a row for every container
+probing and a column for every container probed. the arrow keys move a
+cursor over it, scrolling it when it is too big for the terminal. container names are coloured by state:
+white while running, cyan while frozen, red while stopped and yellow while
+starting or stopping. a link that fails while the reverse link works, such
+as one cut by a drop fault, is drawn in magenta instead of red. a container
+whose clock is skewed has the skew written in yellow to the right of its row.
+
+pressing h switches to a heatmap view that shades every cell by the 95th
+percentile latency of the link's recent probes, as reported by daemon every
+few seconds, so a degraded link stands out from a healthy one. failing links
+are drawn as --. press h again to go back.
+
+faults can be injected from watch: c cuts the link between the cursor's row
+and column in both directions, o cuts it one way only, from the row to the
+column, i isolates the row's container from all the
+others, k kills it and p pauses it. u heals the newest fault and x heals
+them all. the line below the event line lists the active faults. press ?
+for a summary of the keys.
 
 watch supports the following flags:
 
+	-slow duration
+		successful probes that take longer than this are drawn in yellow
+		instead of green. defaults to 200ms.
+
+	-probe name
+		only show the results of the named probe, e.g. tcp:5432, when the
+		daemon runs several. by default each cell shows the latest result
+		of any probe.
+
+	-replay file
+		instead of connecting to daemon, animate a history file recorded
+		with -history. while replaying:
+			space    pause or resume
+			. ,      step one event forward or back (pauses)
+			+ -      double or halve the speed
+			] [      seek 10s forward or back
+			} {      seek 1m forward or back
+			0        go back to the start
+			q        quit
+
+	-run n
+		replay the nth run in the history file. defaults to 1.
 `,
 }
 
@@ -38,10 +89,20 @@ func runWatch(c *Command, args []string) {
 	signalChan := make(chan os.Signal, 100)
 	signal.Notify(signalChan, syscall.SIGINT)
 
-	startTermbox(signalChan)
-	drawGrid()
-
-	go listenForUpdates(signalChan)
+	if replayPath != "" {
+		r, err := loadReplay(replayPath, replayRun)
+		if err != nil {
+			log.Fatalf("[error]: %v\n", err)
+		}
+		r.signalChan = signalChan
+		startTermbox(signalChan, r.key)
+		go r.play()
+	} else {
+		startTermbox(signalChan, interactiveKey)
+		drawGrid()
+		setFooter("? for help")
+		go listenForUpdates(signalChan)
+	}
 
 	for {
 		select {
@@ -49,6 +110,9 @@ func runWatch(c *Command, args []string) {
 			switch sig {
 			case syscall.SIGINT:
 				termbox.Close()
+				if watchErr != nil {
+					log.Fatalf("[error]: %v\n", watchErr)
+				}
 				os.Exit(0)
 			default:
 			}
@@ -62,32 +126,160 @@ retry:
 	conn, err := net.Dial("tcp", serverIP + ":" + strconv.Itoa(defaultPort)) // eventually this will be udp broadcast autodiscovery...
 	if err != nil {
 		if retriesRemaining < 0 {
-			signalChan <- syscall.SIGINT
+			fatalWatch(signalChan, fmt.Errorf("could not connect to daemon: %v", err))
 			return
 		}
 		retriesRemaining--
 		time.Sleep(600 * time.Millisecond)
 		goto retry
 	}
-	r := bufio.NewReader(conn)
-	var to, from string
-	var outcome bool
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	if err := dialHandshake(conn, enc, dec); err != nil {
+		fatalWatch(signalChan, err)
+		return
+	}
+	daemonConn.Lock()
+	daemonConn.enc = enc
+	daemonConn.Unlock()
 	for {
-		msg, err := r.ReadString('\n')
-		if err != nil {
-			continue
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			fatalWatch(signalChan, fmt.Errorf("lost connection to daemon: %v", err))
+			return
 		}
-		// parse msg
-		// update screen
-		_, err = fmt.Sscanf(string(msg), "%s %s %t\n", &from, &to, &outcome)
-		if err != nil {
-			continue
+		switch m.Type {
+		case msgMembers:
+			setMembers(m.Members)
+		case msgProbe:
+			if shownProbe(&m) {
+				drawStatus(probeStatus(&m))
+			}
+		case msgFault:
+			drawEvent(eventText(&m))
+		case msgLatency:
+			setLatency(&m)
+		case msgFaults:
+			setFaults(&m)
+		case msgResult:
+			if m.Error != "" {
+				drawEvent(time.Now().Format("15:04:05") + " command failed: " + m.Error)
+			}
+		case msgError:
+			fatalWatch(signalChan, errors.New(m.Error))
+			return
 		}
-		drawStatus(status{src: from, dest: to, outcome: outcome})
 	}
 }
 
-func startTermbox(signalChan chan os.Signal) {
+// daemonConn is where commands for the daemon are sent.
+var daemonConn struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// sendCommand sends cmd to the daemon. Its outcome arrives as a result
+// message and, if it changed anything, fault events.
+func sendCommand(cmd *watchCommand) {
+	daemonConn.Lock()
+	defer daemonConn.Unlock()
+	if daemonConn.enc == nil {
+		drawEvent("not connected to daemon")
+		return
+	}
+	m := newMessage(msgCommand)
+	m.Command = cmd
+	drawEvent(m.Time.Format("15:04:05") + " sent " + cmd.String())
+	if err := daemonConn.enc.Encode(m); err != nil {
+		drawEvent("could not send command: " + err.Error())
+	}
+}
+
+// watchHelp lists the keys of a watch connected to the daemon.
+var watchHelp = []string{
+	"arrows  move the cursor",
+	"c       cut the link between the cursor's row and column",
+	"o       cut it one way, from the row to the column",
+	"i       isolate the cursor's row from every other container",
+	"k       kill the cursor's row",
+	"p       pause the cursor's row",
+	"u       heal the newest fault",
+	"x       heal every fault",
+	"h       switch between pass/fail and latency heatmap",
+	"?       show this help",
+	"ctrl-c  quit",
+	"",
+	"press any key to close",
+}
+
+// interactiveKey turns key presses into commands for the daemon.
+func interactiveKey(e termbox.Event) {
+	if e.Ch == '?' {
+		showHelp(watchHelp)
+		return
+	}
+	src, dest, ok := cursor()
+	if !ok {
+		return
+	}
+	switch e.Ch {
+	case 'c':
+		if src == dest {
+			drawEvent("move the cursor off the diagonal to cut a link")
+			return
+		}
+		sendCommand(&watchCommand{Action: "inject", Spec: &faultSpec{Type: "partition", Groups: [][]string{{src}, {dest}}}})
+	case 'o':
+		if src == dest {
+			drawEvent("move the cursor off the diagonal to cut a link")
+			return
+		}
+		sendCommand(&watchCommand{Action: "inject", Spec: &faultSpec{Type: "drop", Src: src, Dest: dest}})
+	case 'i':
+		var rest []string
+		for _, name := range memberNames() {
+			if name != src {
+				rest = append(rest, name)
+			}
+		}
+		if len(rest) == 0 {
+			return
+		}
+		sendCommand(&watchCommand{Action: "inject", Spec: &faultSpec{Type: "partition", Groups: [][]string{{src}, rest}}})
+	case 'k':
+		sendCommand(&watchCommand{Action: "inject", Spec: &faultSpec{Type: "kill", Node: src}})
+	case 'p':
+		sendCommand(&watchCommand{Action: "inject", Spec: &faultSpec{Type: "pause", Node: src}})
+	case 'u':
+		board.Lock()
+		id := 0
+		if n := len(board.faults); n > 0 {
+			id = board.faults[n-1].ID
+		}
+		board.Unlock()
+		if id == 0 {
+			drawEvent("no active faults")
+			return
+		}
+		sendCommand(&watchCommand{Action: "heal", ID: id})
+	case 'x':
+		sendCommand(&watchCommand{Action: "heal-all"})
+	}
+}
+
+// watchErr is reported once the terminal has been restored.
+var watchErr error
+
+// fatalWatch shuts watch down and reports err.
+func fatalWatch(signalChan chan os.Signal, err error) {
+	watchErr = err
+	signalChan <- syscall.SIGINT
+}
+
+// startTermbox takes over the terminal and handles the keys common to every
+// dashboard. Any other key press is passed to keys, if it is not nil.
+func startTermbox(signalChan chan os.Signal, keys func(e termbox.Event)) {
 	err := termbox.Init()
 	if err != nil {
 		log.Fatalf("[error]: could not start termbox: %v\n", err)
@@ -102,6 +294,28 @@ func startTermbox(signalChan chan os.Signal) {
 					signalChan <- syscall.SIGINT
 					return
 				}
+				if helpShown() {
+					showHelp(nil)
+					continue
+				}
+				switch e.Key {
+				case termbox.KeyArrowUp:
+					moveCursor(-1, 0)
+				case termbox.KeyArrowDown:
+					moveCursor(1, 0)
+				case termbox.KeyArrowLeft:
+					moveCursor(0, -1)
+				case termbox.KeyArrowRight:
+					moveCursor(0, 1)
+				default:
+					if e.Ch == 'h' {
+						toggleHeatmap()
+						break
+					}
+					if keys != nil {
+						keys(e)
+					}
+				}
 			case termbox.EventResize:
 				drawGrid()
 			}
@@ -109,52 +323,3 @@ func startTermbox(signalChan chan os.Signal) {
 	}()
 
 }
-
-const x0 = 8
-const y0 = 2
-
-func drawString(s string, x0, y0 int, fg termbox.Attribute) {
-	for i, c := range s {
-		termbox.SetCell(x0+i, y0, c, fg, bgColor)
-	}
-}
-
-func drawGrid() {
-	// print initial grid and axes
-	drawString("   from\\to", 0, 0, fgColor)
-	drawString("+", x0, y0, fgColor)
-	for i := 0; i <= numContainers; i++ {
-		for j := 0; j <= numContainers; j++ {
-			drawString("----+", x0+5*j, y0+2*i, fgColor)
-			drawString("|", x0+5*j+4, y0+(2*i-1), fgColor)
-		}
-	}
-	for i := 0; i < numContainers; i++ {
-		drawString("n", x0+6+5*i, y0-1, fgColor)
-		drawString(strconv.Itoa(i), x0+7+5*i, y0-1, fgColor)
-
-		drawString("n", x0+1, y0+2*i+1, fgColor)
-		drawString(strconv.Itoa(i), x0+2, y0+2*i+1, fgColor)
-	}
-	termbox.HideCursor()
-	termbox.Flush()
-}
-
-func drawStatus(s status) {
-	src, _ := strconv.Atoi(s.src[len(s.src)-1:])
-	dest, _ := strconv.Atoi(s.dest[len(s.dest)-1:])
-	x, y := curlOutputCell(x0, y0, src, dest)
-	fg := termbox.ColorRed
-	if s.outcome {
-		fg = termbox.ColorGreen
-	}
-
-	drawString("██", x, y, fg)
-	termbox.Flush()
-}
-
-func curlOutputCell(x0, y0, src, dest int) (int, int) {
-	x := x0 + 6 + 5*dest
-	y := y0 + 1 + 2*src
-	return x, y
-}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A workload drives clients of the system under test from the containers
+// while faults come and go, and records every operation in the history so
+// that jk check can tell whether the system behaved. The only workload is a
+// single register that is read, written and compare-and-set, as in Jepsen.
+//
+// Each operation is recorded twice: once when it is invoked, and once when
+// it completes as ok, fail if it certainly did not take effect, or info if
+// it is unknown whether it did, e.g. because it timed out. A process whose
+// operation ended in info may still have it in flight, so it is retired and
+// the worker carries on as a new process.
+type workloadSpec struct {
+	// Type is the kind of workload, register.
+	Type string `json:"type"`
+
+	// Client is how operations reach the system: cmd, which runs the
+	// Read, Write and CAS command templates in the container, or memory,
+	// an in-process register that is always linearizable.
+	Client string `json:"client,omitempty"`
+	Read   string `json:"read,omitempty"`
+	Write  string `json:"write,omitempty"`
+	CAS    string `json:"cas,omitempty"`
+
+	// Concurrency is the number of workers, spread over the containers
+	// round-robin. It defaults to one per container.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// Interval is the mean pause of a worker between operations.
+	Interval duration `json:"interval,omitempty"`
+
+	// Timeout bounds every operation; one that takes longer is info.
+	Timeout duration `json:"timeout,omitempty"`
+
+	// Values is how many distinct values are written, 0 to Values-1. Few
+	// values make compare-and-set succeed often.
+	Values int `json:"values,omitempty"`
+}
+
+// registerClient performs register operations from a container. Read
+// returns nil for a register that was never written. An error wrapping
+// errFailed means the operation certainly did not take effect; any other
+// error leaves it unknown.
+type registerClient interface {
+	Read(c *container) (*int, error)
+	Write(c *container, value int) error
+	CAS(c *container, old, new int) error
+}
+
+// errFailed is wrapped by client errors for operations that did not happen.
+var errFailed = errors.New("failed")
+
+// clientTypes lists the register clients by the name used in workload specs.
+var clientTypes = map[string]func(spec *workloadSpec) (registerClient, error){
+	"cmd":    newCmdClient,
+	"memory": newMemoryClient,
+}
+
+// workloadPath is the -workload flag shared by daemon and chaos.
+var workloadPath string
+
+func addWorkloadFlag(f *flag.FlagSet) {
+	f.StringVar(&workloadPath, "workload", "", "")
+}
+
+// workloadFlagDoc documents -workload in the Long text of those commands.
+const workloadFlagDoc = `
+	-workload file
+		run the client workload described by the JSON object in file while
+		faults are injected, and record its operations in the history for
+		'jk check'. see 'jk help check'.
+`
+
+// loadWorkload reads the workload named by -workload, or returns nil if
+// there is none.
+func loadWorkload() (*workloadSpec, error) {
+	if workloadPath == "" {
+		return nil, nil
+	}
+	f, err := os.Open(workloadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	spec := &workloadSpec{}
+	if err := json.NewDecoder(f).Decode(spec); err != nil {
+		return nil, fmt.Errorf("%s: %v", workloadPath, err)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", workloadPath, err)
+	}
+	return spec, nil
+}
+
+// validate checks spec for mistakes and fills in defaults.
+func (spec *workloadSpec) validate() error {
+	if spec.Type != "register" {
+		return fmt.Errorf("unknown workload %q", spec.Type)
+	}
+	if spec.Client == "" {
+		spec.Client = "cmd"
+	}
+	if _, ok := clientTypes[spec.Client]; !ok {
+		return fmt.Errorf("unknown client %q", spec.Client)
+	}
+	if spec.Interval == 0 {
+		spec.Interval = duration(100 * time.Millisecond)
+	}
+	if spec.Timeout == 0 {
+		spec.Timeout = duration(5 * time.Second)
+	}
+	if spec.Values == 0 {
+		spec.Values = 5
+	}
+	if spec.Concurrency < 0 || spec.Interval < 0 || spec.Timeout < 0 || spec.Values < 0 {
+		return fmt.Errorf("negative concurrency, interval, timeout or values")
+	}
+	_, err := clientTypes[spec.Client](spec)
+	return err
+}
+
+// workload is a running workload.
+type workload struct {
+	spec    *workloadSpec
+	client  registerClient
+	logChan chan<- *message
+	stop    chan bool
+	wg      sync.WaitGroup
+}
+
+// startWorkload starts the workers of spec against containers. Their
+// operations are sent to logChan.
+func startWorkload(spec *workloadSpec, containers map[string]*container, logChan chan<- *message) *workload {
+	client, err := clientTypes[spec.Client](spec)
+	if err != nil {
+		log.Fatalf("[error]: %v\n", err)
+	}
+	list := clusterList(containers)
+	n := spec.Concurrency
+	if n == 0 {
+		n = len(list)
+	}
+	w := &workload{spec: spec, client: client, logChan: logChan, stop: make(chan bool)}
+	log.Printf("[workload]: %d %s clients\n", n, spec.Client)
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go w.worker(i, n, containers)
+	}
+	return w
+}
+
+// Stop stops the workers and waits for the operations in flight to end.
+func (w *workload) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// worker runs the operations of one client. Clients are spread over the
+// containers in the cluster, picked again for every operation, so that they
+// follow joins and leaves.
+func (w *workload) worker(slot, n int, containers map[string]*container) {
+	defer w.wg.Done()
+	process := slot
+	r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(process)))
+	for {
+		pause := time.Duration(r.Int63n(int64(2*w.spec.Interval) + 1))
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(pause):
+		}
+		list := clusterList(containers)
+		if len(list) == 0 {
+			continue
+		}
+		c := list[slot%len(list)]
+		op := w.generate(r)
+		op.Process, op.Node = process, c.name
+		w.record(op)
+		done := w.invoke(c, op)
+		w.record(done)
+		if done.Type == "info" {
+			process += n
+		}
+	}
+}
+
+// generate picks the next operation: half reads, a quarter each writes and
+// compare-and-sets of random values.
+func (w *workload) generate(r *rand.Rand) *operation {
+	op := &operation{Type: "invoke"}
+	value := r.Intn(w.spec.Values)
+	switch r.Intn(4) {
+	case 0, 1:
+		op.F = "read"
+	case 2:
+		op.F, op.Value = "write", &value
+	case 3:
+		old := r.Intn(w.spec.Values)
+		op.F, op.Old, op.Value = "cas", &old, &value
+	}
+	return op
+}
+
+// invoke performs op from c and returns its completion.
+func (w *workload) invoke(c *container, op *operation) *operation {
+	done := *op
+	var err error
+	switch op.F {
+	case "read":
+		done.Value, err = w.client.Read(c)
+	case "write":
+		err = w.client.Write(c, *op.Value)
+	case "cas":
+		err = w.client.CAS(c, *op.Old, *op.Value)
+	}
+	switch {
+	case err == nil:
+		done.Type = "ok"
+	case errors.Is(err, errFailed) || op.F == "read":
+		// a read that did not return changed nothing
+		done.Type, done.Error = "fail", err.Error()
+	default:
+		done.Type, done.Error = "info", err.Error()
+	}
+	return &done
+}
+
+func (w *workload) record(op *operation) {
+	m := newMessage(msgOp)
+	m.Op = op
+	w.logChan <- m
+}
+
+// cmdClient runs shell commands in the container to operate the register.
+// {value}, {old} and {new} in the templates are replaced by the operation's
+// values, {node} and {ip} by the container's name and address. read must
+// print the value, or nothing if the register is empty. A command that
+// exits with status 1 failed, e.g. a compare-and-set whose comparison
+// failed; other non-zero statuses and timeouts leave the outcome unknown.
+type cmdClient struct {
+	read, write, cas string
+	timeout          time.Duration
+}
+
+func newCmdClient(spec *workloadSpec) (registerClient, error) {
+	if spec.Read == "" || spec.Write == "" || spec.CAS == "" {
+		return nil, fmt.Errorf("cmd client needs read, write and cas commands")
+	}
+	return &cmdClient{read: spec.Read, write: spec.Write, cas: spec.CAS, timeout: time.Duration(spec.Timeout)}, nil
+}
+
+// run runs a command template in c and returns its output.
+func (cl *cmdClient) run(c *container, template string, pairs ...string) ([]byte, error) {
+	pairs = append(pairs, "{node}", c.name, "{ip}", c.IP())
+	command := strings.NewReplacer(pairs...).Replace(template)
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := c.rt.Exec(c.name, "timeout", seconds(duration(cl.timeout)), "sh", "-c", command)
+		done <- result{out, err}
+	}()
+	select {
+	case r := <-done:
+		var exit *exec.ExitError
+		if errors.As(r.err, &exit) && exit.ExitCode() == 1 {
+			return r.out, fmt.Errorf("%s: exit status 1: %w", command, errFailed)
+		}
+		if r.err != nil {
+			return r.out, fmt.Errorf("%s: %v", command, r.err)
+		}
+		return r.out, nil
+	case <-time.After(cl.timeout + time.Second):
+		// attaching hangs while the container is frozen
+		return nil, fmt.Errorf("%s: timed out", command)
+	}
+}
+
+func (cl *cmdClient) Read(c *container) (*int, error) {
+	out, err := cl.run(c, cl.read)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: read %q", cl.read, s)
+	}
+	return &v, nil
+}
+
+func (cl *cmdClient) Write(c *container, value int) error {
+	_, err := cl.run(c, cl.write, "{value}", strconv.Itoa(value))
+	return err
+}
+
+func (cl *cmdClient) CAS(c *container, old, new int) error {
+	_, err := cl.run(c, cl.cas, "{old}", strconv.Itoa(old), "{new}", strconv.Itoa(new), "{value}", strconv.Itoa(new))
+	return err
+}
+
+// memoryClient is a register kept by the daemon itself. It answers only
+// from running containers, so it shows operations failing under faults, but
+// it is always linearizable. It is meant for trying out workloads and jk
+// check with the fake runtime.
+type memoryClient struct {
+	mu    sync.Mutex
+	value *int
+}
+
+func newMemoryClient(spec *workloadSpec) (registerClient, error) {
+	return &memoryClient{}, nil
+}
+
+func (m *memoryClient) up(c *container) error {
+	if c.State() != stateRunning {
+		return fmt.Errorf("%s is %s: %w", c.name, c.State(), errFailed)
+	}
+	return nil
+}
+
+func (m *memoryClient) Read(c *container) (*int, error) {
+	if err := m.up(c); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.value, nil
+}
+
+func (m *memoryClient) Write(c *container, value int) error {
+	if err := m.up(c); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value = &value
+	return nil
+}
+
+func (m *memoryClient) CAS(c *container, old, new int) error {
+	if err := m.up(c); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.value == nil || *m.value != old {
+		return fmt.Errorf("cas %d %d: register is not %d: %w", old, new, old, errFailed)
+	}
+	m.value = &new
+	return nil
+}